@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// alertTimeout is the timeout for posting an alert to the webhook.
+const alertTimeout = 10 * time.Second
+
+// Alert is the JSON body posted to the alert webhook.
+type Alert struct {
+	Alert     string            `json:"alert"`
+	Message   string            `json:"message"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// alerter posts alerts that need an operator's attention to a webhook. An
+// alerter without a URL only logs them.
+type alerter struct {
+	url    string
+	client *http.Client
+	lo     *slog.Logger
+}
+
+// send logs an alert and posts it to the webhook, if any, in the background.
+func (a *alerter) send(name, msg string, labels map[string]string) {
+	a.lo.Error("ALERT: "+msg, "alert", name, "labels", labels)
+	if a.url == "" {
+		return
+	}
+
+	b, err := json.Marshal(Alert{
+		Alert:     name,
+		Message:   msg,
+		Labels:    labels,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		a.lo.Error("failed to marshal alert", "alert", name, "error", err)
+		return
+	}
+
+	go func() {
+		if err := a.post(b); err != nil {
+			a.lo.Error("failed to send alert", "alert", name, "url", a.url, "error", err)
+		}
+	}()
+}
+
+func (a *alerter) post(body []byte) error {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+
+	return nil
+}
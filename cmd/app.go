@@ -1,319 +1,595 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/knadh/koanf/v2"
 	"github.com/zerodha/mii-lama/internal/metrics"
 	"github.com/zerodha/mii-lama/internal/nse"
+	"github.com/zerodha/mii-lama/internal/retry"
+	"github.com/zerodha/mii-lama/internal/spool"
 	"github.com/zerodha/mii-lama/pkg/models"
 	"golang.org/x/exp/slog"
 )
 
 type App struct {
-	lo   *slog.Logger
+	lo *slog.Logger
+
+	// spec is the LAMA metrics spec, which defines the categories. It's
+	// loaded at startup.
+	spec *nse.Spec
+
+	// live is the part of the app that's replaced on a config reload.
+	live atomic.Pointer[liveConfig]
+
+	nseMgr *nse.Manager
+
+	// alerts raises alerts that need an operator's attention.
+	alerts *alerter
+
+	// spool holds requests that could not be pushed. It's nil if disabled.
+	spool *spool.Spool
+
+	// cycles tracks missed sync cycles for the readiness check.
+	cycles *cycleTracker
+
+	// rejections summarises the measures rejected by LAMA.
+	rejections *rejectionTracker
+
+	// dryRun receives the fetched values and the payloads instead of LAMA.
+	// It's nil unless dry run is enabled.
+	dryRun io.Writer
+
+	// prometheus and lama are ready once they've been reached at least
+	// once. No category is synced until both are.
+	prometheus *dependency
+	lama       *dependency
+
+	// locations, if set, are the only locations synced by --once. The
+	// spooled entries of other locations are left in the spool.
+	locations []int
+}
+
+// liveConfig is the part of the app that's built from the config and is
+// swapped as a whole when the config is reloaded. It must not be modified
+// once it's in use.
+type liveConfig struct {
+	ko   *koanf.Koanf
 	opts Opts
 
 	metricsMgr *metrics.Manager
-	nseMgr     *nse.Manager
 
-	hardwareSvc    *hardwareService
-	dbSvc          *dbService
-	networkSvc     *networkService
-	applicationSvc *applicationService
+	// services are the queries and hosts of every category, by name.
+	services map[string]*categoryService
+}
+
+// cfg returns the current live config.
+func (app *App) cfg() *liveConfig {
+	return app.live.Load()
 }
 
 type Opts struct {
-	MaxRetries    int
-	RetryInterval time.Duration
-	SyncInterval  time.Duration
+	MaxRetries       int
+	RetryInterval    time.Duration
+	RetryMaxInterval time.Duration
+	RetryJitter      float64
+	SyncInterval     time.Duration
+
+	// ReadyMaxMissedCycles is the number of consecutive missed sync cycles
+	// of a category after which the app is reported as not ready. 0
+	// disables the check.
+	ReadyMaxMissedCycles int
+
+	// DiscoveryInterval is the interval at which hosts discovered from the
+	// Prometheus API are refreshed. 0 disables refreshing.
+	DiscoveryInterval time.Duration
+
+	// ResubmitRejected enables resubmitting measures rejected in a partially
+	// successful response, if their values can be fixed.
+	ResubmitRejected bool
+
+	// Categories are the options of every metrics category, by name.
+	Categories map[string]CategoryOpts
+}
+
+// CategoryOpts are the options of a metrics category.
+type CategoryOpts struct {
+	// Enabled categories are synced. Disabled ones have no worker and make
+	// no LAMA calls.
+	Enabled bool
+
+	// SyncInterval is the interval at which the category is synced.
+	// Defaults to Opts.SyncInterval.
+	SyncInterval time.Duration
+
+	// SyncTimeout is the deadline for a single fetch and push cycle.
+	SyncTimeout time.Duration
 }
 
 type HostConfig map[int]string
 
-type hardwareService struct {
-	hosts   HostConfig
-	queries map[string]string
+// hostSet holds the hosts of a category and their labels. Discovery may
+// replace them while they're being synced, so the maps are never modified
+// in place.
+type hostSet struct {
+	mu     sync.RWMutex
+	hosts  HostConfig
+	labels map[int]map[string]string
 }
 
-type dbService struct {
-	hosts   HostConfig
-	queries map[string]string
+func newHostSet(hosts HostConfig, labels map[int]map[string]string) *hostSet {
+	return &hostSet{hosts: hosts, labels: labels}
 }
 
-type networkService struct {
-	hosts   HostConfig
-	queries map[string]string
+// get returns the current hosts and labels. They must not be modified.
+func (h *hostSet) get() (HostConfig, map[int]map[string]string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.hosts, h.labels
 }
 
-type applicationService struct {
-	hosts   HostConfig
-	queries map[string]string
+// host returns the host of a location.
+func (h *hostSet) host(locationID int) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.hosts[locationID]
 }
 
-func (app *App) fetchHWMetrics() (map[int]models.HWPromResp, error) {
-	hwMetrics := make(map[int]models.HWPromResp)
-
-	for locationID, host := range app.hardwareSvc.hosts {
-		hwMetricsResp := models.HWPromResp{}
-		for metric, query := range app.hardwareSvc.queries {
-			switch metric {
-			case "cpu":
-				value, err := app.metricsMgr.Query(fmt.Sprintf(query, host))
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				hwMetricsResp.CPU = value
-
-			case "memory":
-				value, err := app.metricsMgr.Query(fmt.Sprintf(query, host, host, host, host))
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				hwMetricsResp.Mem = value
-
-			case "disk":
-				value, err := app.metricsMgr.Query(fmt.Sprintf(query, host, host))
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				hwMetricsResp.Disk = value
-
-			case "uptime":
-				value, err := app.metricsMgr.Query(fmt.Sprintf(query, host, host))
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				hwMetricsResp.Uptime = value
+// set replaces the hosts and labels.
+func (h *hostSet) set(hosts HostConfig, labels map[int]map[string]string) {
+	h.mu.Lock()
+	h.hosts, h.labels = hosts, labels
+	h.mu.Unlock()
+}
 
-			default:
-				app.lo.Warn("Unknown hardware metric queried",
-					"host", host,
-					"metric", metric)
-			}
+// categoryService holds the queries and hosts of a metrics category.
+type categoryService struct {
+	cat nse.Category
+
+	*hostSet
+	queries map[string]*metrics.Query
+
+	// discovery, if set, discovers the hosts from the Prometheus API.
+	discovery *apiDiscovery
+}
+
+// fetchMetrics fetches the samples of every measure of a category for every
+// host, as of at. It returns the samples of the locations that were fetched,
+// and the errors of the ones that weren't.
+func (app *App) fetchMetrics(ctx context.Context, svc *categoryService, at time.Time) (map[int]models.Samples, map[int]error) {
+	var (
+		out    = make(map[int]models.Samples)
+		failed = make(map[int]error)
+	)
+
+	hosts, labels := svc.get()
+	for locationID, host := range hosts {
+		samples, err := app.fetchLocation(ctx, svc, locationID, host, labels, at)
+		if err != nil {
+			failed[locationID] = err
+			continue
 		}
 
-		hwMetrics[locationID] = hwMetricsResp
-		app.lo.Debug("fetched metrics", "host", host, "locationID", locationID, "data", hwMetricsResp)
+		out[locationID] = samples
+		app.lo.Debug("fetched metrics", "category", svc.cat.Name, "host", host, "locationID", locationID, "data", samples)
 	}
 
-	return hwMetrics, nil
+	return out, failed
 }
 
-func (app *App) fetchDBMetrics() (map[int]models.DBPromResp, error) {
-	dbMetrics := make(map[int]models.DBPromResp)
-
-	for locationID, host := range app.dbSvc.hosts {
-		dbMetricsResp := models.DBPromResp{}
-		for metric, query := range app.dbSvc.queries {
-			switch metric {
-			case "status":
-				value, err := app.metricsMgr.Query(fmt.Sprintf(query, host))
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus for database status",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				dbMetricsResp.Status = value
+// fetchLocation fetches the samples of every measure of a category that has a
+// query for a location, as of at. Simple measures are fetched with an
+// instant query, and the rest as samples over the sync interval. If the query
+// of a required measure fails, the location fails, so that it isn't pushed
+// with the measure missing. Optional measures whose query fails, eg: as it
+// returns no series, are left out, unless no measure could be fetched at all.
+func (app *App) fetchLocation(ctx context.Context, svc *categoryService, locationID int, host string, labels map[int]map[string]string, at time.Time) (models.Samples, error) {
+	var (
+		samples = make(models.Samples, len(svc.cat.Measures))
+		vars    = app.queryVars(svc.cat.Name, locationID, host, labels)
+		lastErr error
+	)
+	for _, m := range svc.cat.Measures {
+		tpl, ok := svc.queries[m.Query]
+		if !ok {
+			continue
+		}
 
-			default:
-				app.lo.Warn("Unknown database metric queried",
-					"host", host,
-					"metric", metric)
+		value, err := app.fetchMeasure(ctx, svc.cat.Name, m, host, tpl, vars, at)
+		if err != nil {
+			if m.Required {
+				return nil, err
 			}
+
+			app.lo.Warn("Leaving out optional measure", "category", svc.cat.Name, "host", host, "locationID", locationID, "measure", m.Query, "error", err)
+			lastErr = err
+			continue
 		}
 
-		dbMetrics[locationID] = dbMetricsResp
-		app.lo.Debug("fetched metrics", "host", host, "locationID", locationID, "data", dbMetricsResp)
+		samples[m.Query] = value
+	}
+
+	// If nothing could be fetched, Prometheus is likely unreachable.
+	if len(samples) == 0 && lastErr != nil {
+		return nil, lastErr
 	}
-	return dbMetrics, nil
+
+	return samples, nil
 }
 
-func (app *App) fetchNetworkMetrics() (map[int]models.NetworkPromResp, error) {
-	networkMetrics := make(map[int]models.NetworkPromResp)
-
-	for locationID, host := range app.networkSvc.hosts {
-		networkMetricsResp := models.NetworkPromResp{}
-		for metric, query := range app.networkSvc.queries {
-			switch metric {
-			case "packet_errors":
-				value, err := app.metricsMgr.Query(fmt.Sprintf(query, host, host))
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				networkMetricsResp.PacketErrors = value
+// fetchMeasure renders the query of a measure for a location and fetches its
+// samples as of at.
+func (app *App) fetchMeasure(ctx context.Context, category string, m nse.Measure, host string, tpl *metrics.Query, vars metrics.QueryVars, at time.Time) ([]float64, error) {
+	query, err := tpl.Render(vars)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render query %s: %v", m.Query, err)
+	}
 
-			default:
-				app.lo.Warn("Unknown network metric queried",
-					"host", host,
-					"metric", metric)
-			}
-		}
+	var value []float64
+	if m.Kind == nse.Simple {
+		value, err = app.queryInstant(ctx, category, host, query, at)
+	} else {
+		value, err = app.querySamples(ctx, category, host, query, at)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Prometheus for %s: %v", m.Query, err)
+	}
+
+	return value, nil
+}
 
-		networkMetrics[locationID] = networkMetricsResp
-		app.lo.Debug("fetched metrics", "host", host, "locationID", locationID, "data", networkMetricsResp)
+// queryVars returns the variables for rendering the queries of a location.
+func (app *App) queryVars(category string, locationID int, host string, labels map[int]map[string]string) metrics.QueryVars {
+	return metrics.QueryVars{
+		Host:       host,
+		LocationID: locationID,
+		Interval:   metrics.FormatDuration(app.cfg().opts.Categories[category].SyncInterval),
+		Labels:     labels[locationID],
 	}
+}
 
-	return networkMetrics, nil
+// querySamples queries the samples of a metric over the sync interval ending
+// at at.
+func (app *App) querySamples(ctx context.Context, category, host, query string, at time.Time) ([]float64, error) {
+	start := time.Now()
+	cfg := app.cfg()
+	samples, err := cfg.metricsMgr.QuerySamples(ctx, query, cfg.opts.Categories[category].SyncInterval, at)
+	observeQuery(category, host, start, err)
+
+	return samples, err
 }
 
-func (app *App) fetchApplicationMetrics() (map[int]models.AppPromResp, error) {
-	appMetrics := make(map[int]models.AppPromResp)
-
-	for locationID, host := range app.applicationSvc.hosts {
-		appMetricsResp := models.AppPromResp{}
-		for metric, query := range app.applicationSvc.queries {
-			switch metric {
-			case "throughput":
-				value, err := app.metricsMgr.Query(query)
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				appMetricsResp.Throughput = value
-
-			case "failure_count":
-				value, err := app.metricsMgr.Query(query)
-				if err != nil {
-					app.lo.Error("Failed to query Prometheus",
-						"host", host,
-						"metric", metric,
-						"error", err)
-					continue
-				}
-				appMetricsResp.FailureCount = value
+// queryInstant queries the value of a metric at at and returns it as a single
+// sample. It's used for metrics reported to LAMA as a simple value.
+func (app *App) queryInstant(ctx context.Context, category, host, query string, at time.Time) ([]float64, error) {
+	start := time.Now()
+	value, err := app.cfg().metricsMgr.Query(ctx, query, at)
+	observeQuery(category, host, start, err)
+	if err != nil {
+		return nil, err
+	}
 
-			default:
-				app.lo.Warn("Unknown application metric queried",
-					"host", host,
-					"metric", metric)
-			}
-		}
+	return []float64{value}, nil
+}
+
+// pushSamples builds a request from the samples of a location and pushes it
+// to the category's endpoint.
+func (app *App) pushSamples(ctx context.Context, cat nse.Category, locationID int, host string, samples models.Samples) error {
+	app.writeDryRunValues(cat.Name, locationID, host, samples)
+	return app.pushMetrics(ctx, cat.Name, host, app.nseMgr.NewRequest(cat, locationID, samples))
+}
 
-		appMetrics[locationID] = appMetricsResp
-		app.lo.Debug("fetched metrics", "host", host, "locationID", locationID, "data", appMetricsResp)
+// writeDryRunValues writes the values fetched from Prometheus for a location
+// in dry run mode, so that they can be compared with the payload built from
+// them.
+func (app *App) writeDryRunValues(category string, locationID int, host string, samples models.Samples) {
+	if app.dryRun == nil {
+		return
 	}
 
-	return appMetrics, nil
+	b, err := json.MarshalIndent(struct {
+		Category   string         `json:"category"`
+		LocationID int            `json:"location_id"`
+		Host       string         `json:"host"`
+		Prometheus models.Samples `json:"prometheus"`
+	}{category, locationID, host, samples}, "", "  ")
+	if err != nil {
+		app.lo.Error("Failed to marshal fetched values", "category", category, "error", err)
+		return
+	}
+
+	if _, err := app.dryRun.Write(append(b, '\n')); err != nil {
+		app.lo.Error("Failed to write fetched values", "category", category, "error", err)
+	}
 }
 
-func (app *App) pushHWMetrics(locationID int, host string, data models.HWPromResp) error {
-	for i := 0; i < app.opts.MaxRetries; i++ {
-		if err := app.nseMgr.PushHWMetrics(locationID, host, data); err != nil {
-			if i < app.opts.MaxRetries-1 {
-				app.lo.Error("Failed to push hardware metrics to NSE. Retrying...",
-					"host", host,
-					"locationID", locationID,
-					"attempt", i+1,
-					"error", err)
-				time.Sleep(app.opts.RetryInterval)
-				continue
-			}
-			app.lo.Error("Failed to push hardware metrics to NSE after max retries",
-				"host", host,
-				"locationID", locationID,
-				"max_retries", app.opts.MaxRetries,
-				"error", err)
-			return err
+// pushMetrics pushes a request to a LAMA endpoint, retrying transient failures
+// with exponential backoff up to max_retries attempts. If it still fails, or
+// if ctx is done in the meantime, the request is spooled to be replayed later.
+// Requests rejected permanently by LAMA are dropped.
+func (app *App) pushMetrics(ctx context.Context, endpoint, host string, req nse.MetricsReq) error {
+	p := app.retryPolicy()
+	p.OnRetry = func(attempt int, delay time.Duration, err error) {
+		// A sequence ID resync is expected after a restart with a stale
+		// state, and isn't a failure of LAMA.
+		var seq *nse.ErrSequenceMismatch
+		level := slog.LevelError
+		if errors.As(err, &seq) {
+			level = slog.LevelWarn
 		}
-		break
+
+		app.lo.Log(ctx, level, "Failed to push metrics to NSE. Retrying...",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"attempt", attempt,
+			"retry_in", delay,
+			"error_type", nse.ErrorType(err),
+			"error", err)
+		observeRetry(endpoint)
 	}
-	return nil
+
+	err := p.Do(ctx, func(ctx context.Context) error {
+		return app.push(ctx, endpoint, host, req)
+	})
+	if err == nil {
+		return nil
+	}
+
+	var rej *nse.ErrRejected
+	switch {
+	case ctx.Err() != nil:
+		app.lo.Warn("Aborted pushing metrics to NSE",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"error", err)
+	case errors.Is(err, nse.ErrLoginLocked):
+		app.lo.Error("Failed to push metrics to NSE, logins are paused",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"error", err)
+	case errors.As(err, &rej):
+		app.lo.Error("Metrics rejected by NSE, not retrying",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"response_code", rej.Code,
+			"response_desc", rej.Desc,
+			"errors", rej.Errors)
+		return err
+	case errors.Is(err, nse.ErrPermanent):
+		app.lo.Error("Failed to push metrics to NSE, not retrying",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"error", err)
+		return err
+	case nse.IsRetryable(err):
+		app.lo.Error("Failed to push metrics to NSE after max retries",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"max_retries", app.cfg().opts.MaxRetries,
+			"error", err)
+	default:
+		app.lo.Error("Failed to push metrics to NSE",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"error", err)
+	}
+
+	app.spoolMetrics(endpoint, host, req)
+
+	return err
 }
 
-func (app *App) pushDBMetrics(locationID int, host string, data models.DBPromResp) error {
-	for i := 0; i < app.opts.MaxRetries; i++ {
-		if err := app.nseMgr.PushDBMetrics(locationID, host, data); err != nil {
-			if i < app.opts.MaxRetries-1 {
-				app.lo.Error("Failed to push database metrics to NSE. Retrying...",
-					"host", host,
-					"locationID", locationID,
-					"attempt", i+1,
-					"error", err)
-				time.Sleep(app.opts.RetryInterval)
-				continue
-			}
-			app.lo.Error("Failed to push database metrics to NSE after max retries",
-				"host", host,
-				"locationID", locationID,
-				"max_retries", app.opts.MaxRetries,
-				"error", err)
-			return err
-		}
-		break
+// push makes a single push attempt and records its outcome.
+func (app *App) push(ctx context.Context, endpoint, host string, req nse.MetricsReq) error {
+	start := time.Now()
+	resp, err := app.nseMgr.Push(ctx, endpoint, host, req)
+	observePush(endpoint, resp.ResponseCode, start)
+	if err != nil {
+		observePushError(endpoint, err)
+		return err
 	}
+
+	observePushSuccess(endpoint, req.LocationID)
+	app.handleRejected(ctx, endpoint, host, req, resp, true)
+
 	return nil
 }
 
-func (app *App) pushNetworkMetrics(locationID int, host string, data models.NetworkPromResp) error {
-	for i := 0; i < app.opts.MaxRetries; i++ {
-		if err := app.nseMgr.PushNetworkMetrics(locationID, host, data); err != nil {
-			if i < app.opts.MaxRetries-1 {
-				app.lo.Error("Failed to push network metrics to NSE. Retrying...",
-					"host", host,
-					"locationID", locationID,
-					"attempt", i+1,
+// retryPolicy returns the retry policy for LAMA pushes.
+func (app *App) retryPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: app.cfg().opts.MaxRetries,
+		BaseDelay:   app.cfg().opts.RetryInterval,
+		MaxDelay:    app.cfg().opts.RetryMaxInterval,
+		Jitter:      app.cfg().opts.RetryJitter,
+		Retryable:   nse.IsRetryable,
+	}
+}
+
+// spoolMetrics writes a request that could not be pushed to the spool, if
+// it's enabled, to be replayed later.
+func (app *App) spoolMetrics(endpoint, host string, req nse.MetricsReq) {
+	if app.spool == nil {
+		return
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		app.lo.Error("Failed to marshal request for spooling", "endpoint", endpoint, "error", err)
+		return
+	}
+
+	if err := app.spool.Add(spool.Entry{
+		Endpoint:   endpoint,
+		Host:       host,
+		LocationID: req.LocationID,
+		CreatedAt:  time.Unix(req.Timestamp, 0),
+		Request:    b,
+	}); err != nil {
+		app.lo.Error("Failed to spool request, metrics are lost", "endpoint", endpoint, "host", host, "locationID", req.LocationID, "error", err)
+		return
+	}
+
+	app.lo.Warn("Spooled request for replay", "endpoint", endpoint, "host", host, "locationID", req.LocationID, "spool_depth", app.spool.Depth(endpoint))
+}
+
+// spoolFetch writes an interval of a location whose metrics could not be
+// fetched to the spool, if it's enabled. The metrics are fetched as of at
+// when the entry is replayed.
+func (app *App) spoolFetch(endpoint, host string, locationID int, at time.Time) {
+	if app.spool == nil {
+		return
+	}
+
+	if err := app.spool.Add(spool.Entry{
+		Endpoint:   endpoint,
+		Host:       host,
+		LocationID: locationID,
+		CreatedAt:  at,
+	}); err != nil {
+		app.lo.Error("Failed to spool unfetched metrics, metrics are lost", "endpoint", endpoint, "host", host, "locationID", locationID, "error", err)
+		return
+	}
+
+	app.lo.Warn("Spooled unfetched metrics for replay", "endpoint", endpoint, "host", host, "locationID", locationID, "spool_depth", app.spool.Depth(endpoint))
+}
+
+// errLocationRemoved is returned by fetchSpooled if the location of an entry
+// has been removed from the config, or has another host now.
+var errLocationRemoved = errors.New("location removed")
+
+// fetchSpooled fetches the metrics of a spooled entry as of when it was
+// spooled, and builds its request.
+func (app *App) fetchSpooled(ctx context.Context, e spool.Entry) (nse.MetricsReq, error) {
+	svc, ok := app.cfg().services[e.Endpoint]
+	if !ok {
+		return nse.MetricsReq{}, errLocationRemoved
+	}
+
+	hosts, labels := svc.get()
+	if hosts[e.LocationID] != e.Host {
+		return nse.MetricsReq{}, errLocationRemoved
+	}
+
+	samples, err := app.fetchLocation(ctx, svc, e.LocationID, e.Host, labels, e.CreatedAt)
+	if err != nil {
+		return nse.MetricsReq{}, err
+	}
+
+	req := app.nseMgr.NewRequest(svc.cat, e.LocationID, samples)
+	req.Timestamp = e.CreatedAt.Unix()
+
+	return req, nil
+}
+
+// replaySpool pushes the spooled requests of an endpoint in the order they
+// were spooled. The requests keep their original timestamps and get fresh
+// sequence IDs. The metrics of entries that couldn't be fetched are fetched
+// first, and entries that still can't be are skipped until the next sync.
+// Replay stops at the first failed push, as LAMA is likely still
+// unreachable, and resumes on the next sync.
+func (app *App) replaySpool(ctx context.Context, endpoint string) {
+	if app.spool == nil {
+		return
+	}
+
+	entries, err := app.spool.Entries(endpoint)
+	if err != nil {
+		app.lo.Error("Failed to read spooled requests", "endpoint", endpoint, "error", err)
+		return
+	}
+
+	for _, e := range entries {
+		if len(app.locations) > 0 && !slices.Contains(app.locations, e.LocationID) {
+			continue
+		}
+
+		var req nse.MetricsReq
+		if len(e.Request) == 0 {
+			// The metrics of the entry couldn't be fetched when it was
+			// spooled. They're fetched as of then.
+			r, err := app.fetchSpooled(ctx, e)
+			if errors.Is(err, errLocationRemoved) {
+				app.lo.Warn("Dropping spooled metrics of a removed location", "endpoint", endpoint, "host", e.Host, "locationID", e.LocationID)
+				if err := app.spool.Remove(e); err != nil {
+					app.lo.Error("Failed to remove spooled request", "endpoint", endpoint, "id", e.ID, "error", err)
+					return
+				}
+				continue
+			}
+			if err != nil {
+				// Only this location's host may be down, so the entries
+				// after it are still replayed.
+				app.lo.Warn("Failed to fetch spooled metrics, skipping until next sync",
+					"endpoint", endpoint,
+					"host", e.Host,
+					"locationID", e.LocationID,
+					"spool_depth", app.spool.Depth(endpoint),
 					"error", err)
-				time.Sleep(app.opts.RetryInterval)
 				continue
 			}
-			app.lo.Error("Failed to push network metrics to NSE after max retries",
-				"host", host,
-				"locationID", locationID,
-				"max_retries", app.opts.MaxRetries,
-				"error", err)
-			return err
+			req = r
+		} else if err := json.Unmarshal(e.Request, &req); err != nil {
+			app.lo.Error("Dropping malformed spooled request", "endpoint", endpoint, "id", e.ID, "error", err)
+			if err := app.spool.Remove(e); err != nil {
+				app.lo.Error("Failed to remove spooled request", "endpoint", endpoint, "id", e.ID, "error", err)
+				return
+			}
+			continue
 		}
-		break
-	}
-	return nil
-}
 
-func (app *App) pushApplicationMetrics(locationID int, host string, data models.AppPromResp) error {
-	for i := 0; i < app.opts.MaxRetries; i++ {
-		if err := app.nseMgr.PushAppMetrics(locationID, host, data); err != nil {
-			if i < app.opts.MaxRetries-1 {
-				app.lo.Error("Failed to push application metrics to NSE. Retrying...",
-					"host", host,
-					"locationID", locationID,
-					"attempt", i+1,
+		if err := app.push(ctx, endpoint, e.Host, req); err != nil {
+			// A paused login may wrap the rejected login, but the request
+			// itself wasn't rejected.
+			if errors.Is(err, nse.ErrPermanent) && !errors.Is(err, nse.ErrLoginLocked) {
+				app.lo.Error("Dropping spooled request rejected by NSE",
+					"endpoint", endpoint,
+					"host", e.Host,
+					"locationID", e.LocationID,
 					"error", err)
-				time.Sleep(app.opts.RetryInterval)
+				if err := app.spool.Remove(e); err != nil {
+					app.lo.Error("Failed to remove spooled request", "endpoint", endpoint, "id", e.ID, "error", err)
+					return
+				}
 				continue
 			}
-			app.lo.Error("Failed to push application metrics to NSE after max retries",
-				"host", host,
-				"locationID", locationID,
-				"max_retries", app.opts.MaxRetries,
+
+			app.lo.Warn("Failed to replay spooled request, will retry on next sync",
+				"endpoint", endpoint,
+				"host", e.Host,
+				"locationID", e.LocationID,
+				"spool_depth", app.spool.Depth(endpoint),
 				"error", err)
-			return err
+			return
 		}
-		break
+
+		if err := app.spool.Remove(e); err != nil {
+			app.lo.Error("Failed to remove replayed request", "endpoint", endpoint, "id", e.ID, "error", err)
+			return
+		}
+
+		app.lo.Info("Replayed spooled request",
+			"endpoint", endpoint,
+			"host", e.Host,
+			"locationID", e.LocationID,
+			"created_at", e.CreatedAt,
+			"spool_depth", app.spool.Depth(endpoint))
 	}
-	return nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+	"github.com/zerodha/mii-lama/internal/nse/mock"
+	"github.com/zerodha/mii-lama/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+// runStateCmd shows or resets the sequence IDs persisted in the state store.
+//
+//	mii-lama state
+//	mii-lama state reset [endpoint]
+func runStateCmd(ko *koanf.Koanf, args []string) error {
+	store, err := initStateStore(ko)
+	if err != nil {
+		return fmt.Errorf("failed to init state store: %v", err)
+	}
+
+	if len(args) == 0 || args[0] == "show" {
+		seqs, err := store.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load state: %v", err)
+		}
+
+		if len(seqs) == 0 {
+			fmt.Println("no sequence IDs stored")
+			return nil
+		}
+
+		names := make([]string, 0, len(seqs))
+		for name := range seqs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Printf("%-12s %s\n", "ENDPOINT", "LAST_SEQ_ID")
+		for _, name := range names {
+			fmt.Printf("%-12s %d\n", name, seqs[name])
+		}
+
+		return nil
+	}
+
+	if args[0] != "reset" {
+		return fmt.Errorf("unknown state command: %s", args[0])
+	}
+
+	var endpoint string
+	if len(args) > 1 {
+		endpoint = args[1]
+	}
+
+	// A running mii-lama keeps the sequence IDs in memory and would write
+	// them back over the reset.
+	if err := lockStateStore(store); err != nil {
+		if errors.Is(err, state.ErrLocked) {
+			return fmt.Errorf("%v, stop mii-lama before resetting the state", err)
+		}
+		return err
+	}
+
+	if err := store.Reset(endpoint); err != nil {
+		return fmt.Errorf("failed to reset state: %v", err)
+	}
+
+	if endpoint == "" {
+		fmt.Println("reset all stored sequence IDs")
+	} else {
+		fmt.Printf("reset stored sequence ID of %s\n", endpoint)
+	}
+
+	return nil
+}
+
+// runCheckConfigCmd validates the config and prints every problem found.
+//
+//	mii-lama check-config
+func runCheckConfigCmd(ko *koanf.Koanf, path string) error {
+	problems := validateConfig(ko)
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", path)
+		return nil
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	return fmt.Errorf("%s: %d problem(s) found", path, len(problems))
+}
+
+// runMockLAMACmd runs a mock of the NSE LAMA API that accepts the credentials
+// in the `lama.nse` config, until SIGINT/SIGTERM is received.
+//
+//	mii-lama mock-lama
+func runMockLAMACmd(ko *koanf.Koanf, lo *slog.Logger) error {
+	addr := ko.String("mock_lama.address")
+	if addr == "" {
+		addr = ":8888"
+	}
+
+	spec, err := initSpec(ko, lo)
+	if err != nil {
+		return fmt.Errorf("failed to load LAMA spec: %v", err)
+	}
+
+	srv := &http.Server{
+		Addr: addr,
+		Handler: mock.New(mock.Opts{
+			MemberID:   ko.MustString("lama.nse.member_id"),
+			LoginID:    ko.MustString("lama.nse.login_id"),
+			Password:   ko.MustString("lama.nse.password"),
+			ExchangeID: ko.MustInt("lama.nse.exchange_id"),
+			TokenTTL:   ko.Duration("mock_lama.token_ttl"),
+			Spec:       spec,
+			VersionNo:  ko.String("mock_lama.version_no"),
+		}, lo),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	lo.Info("starting mock LAMA API", "address", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	"github.com/zerodha/mii-lama/internal/metrics"
+	"golang.org/x/exp/slog"
+)
+
+// labelLocationID is the static config label that pins the location ID of
+// its target.
+const labelLocationID = "location_id"
+
+type PromConfig struct {
+	ScrapeConfigs []PromScrapeConfig `koanf:"scrape_configs"`
+}
+
+type PromScrapeConfig struct {
+	JobName       string             `koanf:"job_name"`
+	StaticConfigs []PromStaticConfig `koanf:"static_configs"`
+}
+
+type PromStaticConfig struct {
+	Targets []string          `koanf:"targets"`
+	Labels  map[string]string `koanf:"labels"`
+}
+
+// promTarget is a target discovered from the Prometheus config.
+type promTarget struct {
+	host   string
+	labels map[string]string
+}
+
+// initPromConfig loads the Prometheus config used for host discovery. It
+// returns nil if `prometheus.config_path` isn't set.
+func initPromConfig(ko *koanf.Koanf) (*PromConfig, error) {
+	path := ko.String("prometheus.config_path")
+	if path == "" {
+		return nil, nil
+	}
+
+	// Job names and labels may contain dots, so use a delimiter that
+	// doesn't show up in a Prometheus config.
+	k := koanf.New("/")
+	if err := k.Load(file.Provider(path), yaml.Parser()); err != nil {
+		return nil, fmt.Errorf("failed to load prometheus config %s: %v", path, err)
+	}
+
+	var cfg PromConfig
+	if err := k.Unmarshal("", &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse prometheus config %s: %v", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// targets returns the targets of the given jobs (all if empty) in the order
+// they appear in the config. The host of a target is its address without
+// the port. A host that shows up more than once is only returned the first
+// time. Every target is labelled with its job, its instance (the address as
+// written in the config) and the labels of its static config.
+func (c *PromConfig) targets(jobs []string) ([]promTarget, error) {
+	var (
+		out  []promTarget
+		seen = make(map[string]bool)
+	)
+
+	for _, sc := range c.ScrapeConfigs {
+		if len(jobs) > 0 && !slices.Contains(jobs, sc.JobName) {
+			continue
+		}
+
+		for _, st := range sc.StaticConfigs {
+			if _, ok := st.Labels[labelLocationID]; ok && len(st.Targets) > 1 {
+				return nil, fmt.Errorf("job %s: %s label is set on a static config with more than one target", sc.JobName, labelLocationID)
+			}
+
+			for _, t := range st.Targets {
+				host := t
+				if h, _, err := net.SplitHostPort(t); err == nil {
+					host = h
+				}
+				if seen[host] {
+					continue
+				}
+				seen[host] = true
+
+				labels := map[string]string{
+					"job":      sc.JobName,
+					"instance": t,
+				}
+				for k, v := range st.Labels {
+					labels[k] = v
+				}
+
+				out = append(out, promTarget{host: host, labels: labels})
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// discoverHosts derives the hosts of a category from the targets of the given
+// jobs in the Prometheus config. Nothing is kept between restarts, so every
+// target must have an explicit location ID, from pinned, the location map
+// file at locationMap or its location_id label. Otherwise, adding or removing
+// a target would shift the IDs of the others.
+func discoverHosts(prom *PromConfig, jobs []string, pinned HostConfig, locationMap string) (HostConfig, map[int]map[string]string, error) {
+	targets, err := prom.targets(jobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idMap, err := loadLocationMap(locationMap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return assignLocations(targets, pinned, idMap, labelLocationID)
+}
+
+// assignLocations assigns location IDs to discovered targets. IDs are taken,
+// in order of precedence, from:
+//
+//  1. pinned, the hosts listed in `metrics.<category>.hosts`.
+//  2. idMap, the location map file.
+//  3. The idLabel label of the target.
+//
+// A target without an ID is an error, as an ID that depends on the order of
+// targets could report the metrics of a host under another host's location.
+// It returns the hosts and the labels of every discovered location.
+func assignLocations(targets []promTarget, pinned HostConfig, idMap map[string]int, idLabel string) (HostConfig, map[int]map[string]string, error) {
+	var (
+		hosts  = make(HostConfig, len(pinned)+len(targets))
+		labels = make(map[int]map[string]string)
+		byHost = make(map[string]int, len(pinned))
+	)
+	for id, h := range pinned {
+		hosts[id] = h
+		byHost[h] = id
+	}
+
+	for _, t := range targets {
+		if id, ok := byHost[t.host]; ok {
+			labels[id] = t.labels
+			continue
+		}
+
+		id, ok := idMap[t.host]
+		if !ok && idLabel != "" {
+			if v, found := t.labels[idLabel]; found {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid %s label %q for %s", idLabel, v, t.host)
+				}
+				id, ok = n, true
+			}
+		}
+		if !ok {
+			if idLabel == "" {
+				return nil, nil, fmt.Errorf("%s has no location ID, add it to the location map", t.host)
+			}
+			return nil, nil, fmt.Errorf("target %s of job %s has no location ID, set its %s label or add it to the location map", t.host, t.labels["job"], idLabel)
+		}
+
+		if id < 1 {
+			return nil, nil, fmt.Errorf("invalid location %d for %s", id, t.host)
+		}
+		if h, ok := hosts[id]; ok {
+			return nil, nil, fmt.Errorf("location %d of %s is already assigned to %s", id, t.host, h)
+		}
+
+		hosts[id] = t.host
+		byHost[t.host] = id
+		labels[id] = t.labels
+	}
+
+	return hosts, labels, nil
+}
+
+// logHosts logs the host to location ID map of a category.
+func logHosts(lo *slog.Logger, section string, hosts HostConfig) {
+	ids := make([]int, 0, len(hosts))
+	for id := range hosts {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	m := make([]string, 0, len(ids))
+	for _, id := range ids {
+		m = append(m, fmt.Sprintf("%d=%s", id, hosts[id]))
+	}
+
+	lo.Info("discovered hosts", "section", section, "hosts", strings.Join(m, " "))
+}
+
+// mergeLabels merges the labels of every location in override into base.
+func mergeLabels(base, override map[int]map[string]string) map[int]map[string]string {
+	out := make(map[int]map[string]string, len(base))
+	for id, l := range base {
+		out[id] = make(map[string]string, len(l))
+		for k, v := range l {
+			out[id][k] = v
+		}
+	}
+
+	for id, l := range override {
+		if out[id] == nil {
+			out[id] = make(map[string]string, len(l))
+		}
+		for k, v := range l {
+			out[id][k] = v
+		}
+	}
+
+	return out
+}
+
+// Sources of hosts for discovery from the Prometheus API.
+const (
+	discoveryTargets     = "targets"
+	discoveryLabelValues = "label_values"
+)
+
+// apiDiscovery discovers the hosts of a category from the Prometheus API,
+// either from the active scrape targets or from the values of a label.
+type apiDiscovery struct {
+	section  string
+	category string
+	source   string
+	sel      metrics.Selector
+
+	// hostLabel is the label that holds the host. For targets, it defaults
+	// to the instance without the port.
+	hostLabel string
+
+	// locationLabel is the target label that holds the location ID, if any.
+	locationLabel string
+
+	// locationMap is the path to a JSON file that maps hosts to location
+	// IDs, if any. It's read on every discovery.
+	locationMap string
+
+	// pinned are the hosts listed in the config.
+	pinned HostConfig
+
+	// labels are the labels listed in the config. They take precedence over
+	// the discovered ones.
+	labels map[int]map[string]string
+}
+
+// discover returns the hosts of the category and their labels.
+func (d *apiDiscovery) discover(ctx context.Context, mgr *metrics.Manager) (HostConfig, map[int]map[string]string, error) {
+	idMap, err := loadLocationMap(d.locationMap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var targets []promTarget
+	switch d.source {
+	case discoveryTargets:
+		res, err := mgr.Targets(ctx, d.sel)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		seen := make(map[string]bool, len(res))
+		for _, labels := range res {
+			host := labels[d.hostLabel]
+			if d.hostLabel == "" {
+				host = labels["instance"]
+				if h, _, err := net.SplitHostPort(host); err == nil {
+					host = h
+				}
+			}
+			if host == "" || seen[host] {
+				continue
+			}
+			seen[host] = true
+
+			targets = append(targets, promTarget{host: host, labels: labels})
+		}
+
+	case discoveryLabelValues:
+		res, err := mgr.LabelValues(ctx, d.hostLabel, d.sel)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, host := range res {
+			targets = append(targets, promTarget{host: host, labels: map[string]string{d.hostLabel: host}})
+		}
+	}
+
+	hosts, labels, err := assignLocations(targets, d.pinned, idMap, d.locationLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hosts, mergeLabels(labels, d.labels), nil
+}
+
+// loadLocationMap loads the host to location ID map at path. It returns nil
+// if path is empty.
+func loadLocationMap(path string) (map[string]int, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read location map: %v", err)
+	}
+
+	var m map[string]int
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse location map %s: %v", path, err)
+	}
+
+	return m, nil
+}
+
+// discoverHostsFromAPI discovers the hosts of every category of cfg that has
+// discovery from the Prometheus API enabled and returns the first error.
+// The hosts of a category are left as they are if its discovery fails.
+func (app *App) discoverHostsFromAPI(ctx context.Context, cfg *liveConfig) error {
+	var firstErr error
+	for _, c := range app.spec.Categories {
+		s := cfg.services[c.Name]
+		if s.discovery == nil {
+			continue
+		}
+
+		if err := app.refreshHosts(ctx, cfg, s.hostSet, s.queries, s.discovery); err != nil {
+			app.lo.Error("failed to discover hosts", "section", s.discovery.section, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// refreshHosts replaces the hosts of a category with the discovered ones and
+// logs the hosts that were added or removed. Hosts that the queries can't be
+// rendered for are dropped.
+func (app *App) refreshHosts(ctx context.Context, cfg *liveConfig, set *hostSet, queries map[string]*metrics.Query, d *apiDiscovery) error {
+	prev, _ := set.get()
+
+	hosts, labels, err := d.discover(ctx, cfg.metricsMgr)
+	if err != nil {
+		return err
+	}
+
+	for id, host := range hosts {
+		if err := renderQueries(queries, id, host, labels[id], cfg.opts.Categories[d.category].SyncInterval); err != nil {
+			app.lo.Error("dropping discovered host", "section", d.section, "location", id, "host", host, "error", err)
+			delete(hosts, id)
+		}
+	}
+
+	// An empty result is more likely to be a Prometheus hiccup than every
+	// host having gone away.
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts discovered for %s", d.section)
+	}
+
+	for id, host := range prev {
+		if hosts[id] != host {
+			app.lo.Info("host removed", "section", d.section, "location", id, "host", host)
+		}
+	}
+	for id, host := range hosts {
+		if prev[id] != host {
+			app.lo.Info("host added", "section", d.section, "location", id, "host", host)
+		}
+	}
+
+	set.set(hosts, labels)
+
+	return nil
+}
+
+// runDiscovery refreshes the discovered hosts at every discovery interval
+// until ctx is cancelled. The interval is read again after every wait so
+// that a config reload can change it.
+func (app *App) runDiscovery(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		// While refreshing is disabled, check every minute whether a
+		// reload has enabled it.
+		interval := app.cfg().opts.DiscoveryInterval
+		wait := interval
+		if wait <= 0 {
+			wait = time.Minute
+		}
+
+		select {
+		case <-time.After(wait):
+			if interval > 0 {
+				app.discoverHostsFromAPI(ctx, app.cfg())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+)
+
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+)
+
+// cycleTracker tracks the outcome of the sync cycles of every category.
+type cycleTracker struct {
+	sync.Mutex
+
+	// missed is the number of consecutive missed cycles per category.
+	missed map[string]int
+
+	// lastSuccess is the time of the last successful cycle per category.
+	lastSuccess map[string]time.Time
+}
+
+func newCycleTracker() *cycleTracker {
+	return &cycleTracker{
+		missed:      make(map[string]int),
+		lastSuccess: make(map[string]time.Time),
+	}
+}
+
+// record records the outcome of a sync cycle. A cycle that returned an error
+// is a missed cycle.
+func (t *cycleTracker) record(category string, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if err != nil {
+		t.missed[category]++
+		return
+	}
+
+	t.missed[category] = 0
+	t.lastSuccess[category] = time.Now()
+}
+
+// get returns the number of consecutive missed cycles of a category and the
+// time of its last successful cycle.
+func (t *cycleTracker) get(category string) (int, time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.missed[category], t.lastSuccess[category]
+}
+
+// checkResult is the result of a single readiness check.
+type checkResult struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// handleHealth reports that the process is alive.
+func (app *App) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": checkOK})
+}
+
+// handleReady reports whether mii-lama is able to do its job: it's past
+// the degraded startup state, it has a valid LAMA token, Prometheus is
+// reachable and no category has missed too many consecutive sync cycles.
+func (app *App) handleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkResult{
+		"dependencies": app.checkDependencies(),
+		"lama_token":   app.checkToken(),
+		"prometheus":   app.checkPrometheus(r),
+	}
+	for _, ep := range app.enabledCategories() {
+		checks["sync_"+ep] = app.checkSync(ep)
+	}
+
+	var (
+		status = checkOK
+		code   = http.StatusOK
+	)
+	for _, c := range checks {
+		if c.Status != checkOK {
+			status = checkFail
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	writeJSON(w, code, map[string]any{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// checkDependencies fails until Prometheus and LAMA have both been reached,
+// which is when the workers start.
+func (app *App) checkDependencies() checkResult {
+	var (
+		res     = checkResult{Status: checkOK, Details: make(map[string]any)}
+		waiting []string
+	)
+	for _, d := range []*dependency{app.prometheus, app.lama} {
+		attempts, err := d.status()
+		det := map[string]any{
+			"ready":           d.isReady(),
+			"failed_attempts": attempts,
+		}
+		if err != nil {
+			det["last_error"] = err.Error()
+		}
+		res.Details[d.name] = det
+
+		if !d.isReady() {
+			waiting = append(waiting, d.name)
+		}
+	}
+	if len(waiting) > 0 {
+		res.Status = checkFail
+		res.Error = "waiting for " + strings.Join(waiting, ", ")
+	}
+
+	return res
+}
+
+// checkToken fails if there's no LAMA session token, if it has expired or if
+// logins are paused.
+// There's no token in dry run mode.
+func (app *App) checkToken() checkResult {
+	if app.dryRun != nil {
+		return checkResult{Status: checkOK, Details: map[string]any{"dry_run": true}}
+	}
+
+	if app.nseMgr.LoginLocked() {
+		return checkResult{Status: checkFail, Error: "logins paused, LAMA rejected the credentials"}
+	}
+
+	issuedAt := app.nseMgr.TokenIssuedAt()
+	if issuedAt.IsZero() {
+		return checkResult{Status: checkFail, Error: "no session token"}
+	}
+
+	age := time.Since(issuedAt)
+	res := checkResult{
+		Status: checkOK,
+		Details: map[string]any{
+			"issued_at":   issuedAt,
+			"age_seconds": int64(age.Seconds()),
+		},
+	}
+	if age >= nse.TokenTTL {
+		res.Status = checkFail
+		res.Error = "session token is stale"
+	}
+
+	return res
+}
+
+// checkPrometheus fails if Prometheus is unreachable.
+func (app *App) checkPrometheus(r *http.Request) checkResult {
+	if err := app.cfg().metricsMgr.Ping(r.Context()); err != nil {
+		return checkResult{Status: checkFail, Error: err.Error()}
+	}
+
+	return checkResult{Status: checkOK}
+}
+
+// checkSync fails if a category has missed ReadyMaxMissedCycles consecutive
+// sync cycles.
+func (app *App) checkSync(category string) checkResult {
+	missed, last := app.cycles.get(category)
+
+	res := checkResult{
+		Status: checkOK,
+		Details: map[string]any{
+			"missed_cycles": missed,
+		},
+	}
+	if !last.IsZero() {
+		res.Details["last_success"] = last
+	}
+
+	if app.cfg().opts.ReadyMaxMissedCycles > 0 && missed >= app.cfg().opts.ReadyMaxMissedCycles {
+		res.Status = checkFail
+		res.Error = "too many consecutive missed sync cycles"
+	}
+
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
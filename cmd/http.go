@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	vmetrics "github.com/VictoriaMetrics/metrics"
+)
+
+// initHTTPServer returns the HTTP server for the self-monitoring and health
+// check endpoints.
+func initHTTPServer(app *App, address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", app.handleHealth)
+	mux.HandleFunc("/readyz", app.handleReady)
+	mux.HandleFunc("/rejections", app.handleRejections)
+
+	return &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// serveHTTP runs the HTTP server until ctx is cancelled.
+func (app *App) serveHTTP(ctx context.Context, wg *sync.WaitGroup, srv *http.Server) {
+	defer wg.Done()
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			app.lo.Error("error shutting down HTTP server", "error", err)
+		}
+	}()
+
+	app.lo.Info("starting HTTP server", "address", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		app.lo.Error("HTTP server failed", "error", err)
+	}
+}
+
+// handleMetrics exposes the self-monitoring metrics in the Prometheus format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	vmetrics.WritePrometheus(w, true)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/knadh/koanf/parsers/toml"
 	"github.com/knadh/koanf/providers/env"
@@ -13,32 +16,70 @@ import (
 	flag "github.com/spf13/pflag"
 	metrics "github.com/zerodha/mii-lama/internal/metrics"
 	"github.com/zerodha/mii-lama/internal/nse"
+	"github.com/zerodha/mii-lama/internal/spool"
+	"github.com/zerodha/mii-lama/internal/state"
 	"golang.org/x/exp/slog"
 )
 
-type PromConfig struct {
-	ScrapeConfigs []PromScrapeConfig `koanf:"scrape_configs"`
-}
+// configSource is where the config is loaded from: a config file, the
+// environment and the command line flags, in increasing order of precedence.
+// It's kept around to reload the config.
+type configSource struct {
+	path      string
+	envPrefix string
 
-type PromScrapeConfig struct {
-	JobName       string             `koanf:"job_name"`
-	StaticConfigs []PromStaticConfig `koanf:"static_configs"`
+	// overrides are the config keys set by flags.
+	overrides map[string]interface{}
 }
 
-type PromStaticConfig struct {
-	Targets []string `koanf:"targets"`
+// load loads the config from the source.
+func (src *configSource) load() (*koanf.Koanf, error) {
+	ko := koanf.New(".")
+
+	// Load the config files from the path provided.
+	if err := ko.Load(file.Provider(src.path), toml.Parser()); err != nil {
+		return nil, err
+	}
+
+	// Load environment variables if the key is given
+	// and merge into the loaded config.
+	if src.envPrefix != "" {
+		err := ko.Load(env.Provider(src.envPrefix, ".", func(s string) string {
+			return strings.Replace(strings.ToLower(
+				strings.TrimPrefix(s, src.envPrefix)), "__", ".", -1)
+		}), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range src.overrides {
+		if err := ko.Set(k, v); err != nil {
+			return nil, err
+		}
+	}
+
+	return ko, nil
 }
 
 // initConfig loads config to `ko`
-// object.
-func initConfig(cfgDefault, envPrefix string) (*koanf.Koanf, error) {
+// object and returns its source and the positional (subcommand) arguments.
+func initConfig(cfgDefault, envPrefix string) (*koanf.Koanf, *configSource, []string, error) {
 	var (
-		ko = koanf.New(".")
-		f  = flag.NewFlagSet("lama", flag.ContinueOnError)
+		f = flag.NewFlagSet("lama", flag.ContinueOnError)
 	)
 
 	// Configure Flags.
 	f.Usage = func() {
+		fmt.Println("Usage: mii-lama [flags] [command]")
+		fmt.Println()
+		fmt.Println("Commands:")
+		fmt.Println("  state                Show the stored sequence IDs.")
+		fmt.Println("  state reset [name]   Reset the stored sequence ID of an endpoint (all if empty).")
+		fmt.Println("  mock-lama            Run a mock LAMA API server for testing.")
+		fmt.Println("  check-config         Validate the config and print every problem found.")
+		fmt.Println()
+		fmt.Println("Flags:")
 		fmt.Println(f.FlagUsages())
 		os.Exit(0)
 	}
@@ -46,31 +87,42 @@ func initConfig(cfgDefault, envPrefix string) (*koanf.Koanf, error) {
 	// Register `--config` flag.
 	cfgPath := f.String("config", cfgDefault, "Path to a config file to load.")
 
+	// Register `--dry-run` flag.
+	dryRun := f.Bool("dry-run", false, "Print the LAMA payloads instead of submitting them. Overrides app.dry_run.")
+
+	// Register flags for running a single sync cycle.
+	once := f.Bool("once", false, "Run a single fetch and push cycle and exit.")
+	categories := f.StringSlice("category", nil, "Categories of the LAMA spec to sync with --once, eg: hardware. All if empty.")
+	locations := f.IntSlice("location", nil, "Location IDs to sync with --once. All if empty.")
+
 	// Parse and Load Flags.
 	err := f.Parse(os.Args[1:])
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	// Load the config files from the path provided.
-	err = ko.Load(file.Provider(*cfgPath), toml.Parser())
-	if err != nil {
-		return nil, err
+	src := &configSource{
+		path:      *cfgPath,
+		envPrefix: envPrefix,
+		overrides: make(map[string]interface{}),
 	}
 
-	// Load environment variables if the key is given
-	// and merge into the loaded config.
-	if envPrefix != "" {
-		err = ko.Load(env.Provider(envPrefix, ".", func(s string) string {
-			return strings.Replace(strings.ToLower(
-				strings.TrimPrefix(s, envPrefix)), "__", ".", -1)
-		}), nil)
-		if err != nil {
-			return nil, err
-		}
+	if *dryRun {
+		src.overrides["app.dry_run"] = true
 	}
 
-	return ko, nil
+	if *once {
+		src.overrides["once.enabled"] = true
+		src.overrides["once.categories"] = *categories
+		src.overrides["once.locations"] = *locations
+	}
+
+	ko, err := src.load()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return ko, src, f.Args(), nil
 }
 
 // initLogger initialies a logger.
@@ -79,131 +131,334 @@ func initLogger(lvl string) *slog.Logger {
 		AddSource: true,
 		Level:     slog.LevelInfo,
 	}
-	if lvl == "debug" {
+	switch lvl {
+	case "debug":
 		opts.Level = slog.LevelDebug
+	case "warn":
+		opts.Level = slog.LevelWarn
+	case "error":
+		opts.Level = slog.LevelError
 	}
 
 	return slog.New(slog.NewTextHandler(os.Stdout, &opts).WithAttrs([]slog.Attr{slog.String("component", "mii-lama")}))
 }
 
-// initMetricsManager initialises the metrics manager.
-func initMetricsManager(ko *koanf.Koanf) (*metrics.Manager, error) {
+// initMetricsManager initialises the metrics manager. Prometheus isn't
+// reached here, it's checked in the background by app.connectPrometheus.
+func initMetricsManager(ko *koanf.Koanf) *metrics.Manager {
 	opts := metrics.Opts{
 		Endpoint:        ko.MustString("prometheus.endpoint"),
 		QueryPath:       ko.MustString("prometheus.query_path"),
+		QueryRangePath:  ko.MustString("prometheus.query_range_path"),
 		Username:        ko.String("prometheus.username"),
 		Password:        ko.String("prometheus.password"),
 		Timeout:         ko.MustDuration("prometheus.timeout"),
 		IdleConnTimeout: ko.MustDuration("prometheus.idle_timeout"),
 		MaxIdleConns:    ko.MustInt("prometheus.max_idle_conns"),
+		RangeStep:       ko.Duration("prometheus.range_step"),
+		RangeFallback:   ko.Bool("prometheus.range_fallback"),
 	}
 
-	metrics := metrics.NewManager(opts)
+	return metrics.NewManager(opts)
+}
+
+// initLiveConfig initialises the parts of the app that can be changed by a
+// config reload: the options, the metrics manager and the queries and hosts
+// of every category.
+func initLiveConfig(ko *koanf.Koanf, spec *nse.Spec, lo *slog.Logger) (*liveConfig, error) {
+	// Initialise the metrics manager.
+	metricsMgr := initMetricsManager(ko)
+
+	// Load the Prometheus config for discovering hosts, if any.
+	prom, err := initPromConfig(ko)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load prometheus config: %v", err)
+	}
 
-	if err := metrics.Ping(); err != nil {
+	// Load the queries and hosts of every category.
+	services := make(map[string]*categoryService, len(spec.Categories))
+	for _, c := range spec.Categories {
+		svc, err := initCategoryService(ko, c, prom, lo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init %s service: %v", c.Name, err)
+		}
+		services[c.Name] = svc
+	}
+
+	return &liveConfig{
+		ko:         ko,
+		opts:       initOpts(ko, spec),
+		metricsMgr: metricsMgr,
+		services:   services,
+	}, nil
+}
+
+// initCategoryService loads the queries and hosts of a metrics category from
+// its config section.
+func initCategoryService(ko *koanf.Koanf, cat nse.Category, prom *PromConfig, lo *slog.Logger) (*categoryService, error) {
+	hosts, labels, queries, discovery, err := initQueries(ko, cat, prom, lo)
+	if err != nil {
 		return nil, err
 	}
 
-	return metrics, nil
+	return &categoryService{
+		cat:       cat,
+		hostSet:   newHostSet(hosts, labels),
+		queries:   queries,
+		discovery: discovery,
+	}, nil
 }
 
-// Load hardware metrics queries and hosts from the configuration
-func inithardwareSvc(ko *koanf.Koanf) (*hardwareService, error) {
+// initQueries loads the hosts, the per-location labels and the query
+// templates of a metrics category from its config section. Queries of
+// optional measures that are empty are skipped and are left out of the LAMA
+// payload.
+//
+// If `discovery.source` is set, hosts are discovered from the Prometheus API
+// once the app is up, and the returned apiDiscovery is set. Otherwise, they're
+// discovered from the Prometheus config, if it's loaded, when none are listed
+// or when `jobs` are. Every query is rendered for every known host so that
+// template errors are caught at startup instead of on every sync.
+func initQueries(ko *koanf.Koanf, cat nse.Category, prom *PromConfig, lo *slog.Logger) (HostConfig, map[int]map[string]string, map[string]*metrics.Query, *apiDiscovery, error) {
 	var (
-		queries = map[string]string{
-			"cpu":    ko.MustString("metrics.hardware.cpu"),
-			"memory": ko.MustString("metrics.hardware.memory"),
-			"disk":   ko.MustString("metrics.hardware.disk"),
-			"uptime": ko.MustString("metrics.hardware.uptime"),
-		}
-		hosts HostConfig
+		section = "metrics." + cat.Name
+		hosts   HostConfig
+		labels  map[int]map[string]string
+		queries = make(map[string]*metrics.Query)
 	)
 
-	if err := ko.Unmarshal("metrics.hardware.hosts", &hosts); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal hardware hosts: %v", err)
+	// A disabled category has no hosts or queries.
+	if !categoryEnabled(ko, section) {
+		return HostConfig{}, nil, queries, nil, nil
 	}
 
-	if len(hosts) == 0 {
-		return nil, fmt.Errorf("no hosts found in the config for hardware metrics")
+	if err := ko.Unmarshal(section+".hosts", &hosts); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to unmarshal %s hosts: %v", section, err)
+	}
+	if err := ko.Unmarshal(section+".labels", &labels); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to unmarshal %s labels: %v", section, err)
 	}
 
-	return &hardwareService{
-		hosts:   hosts,
-		queries: queries,
-	}, nil
-}
+	discovery, err := initAPIDiscovery(ko, section, hosts, labels)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
 
-// Load hardware metrics queries and hosts from the configuration
-func initDBSvc(ko *koanf.Koanf) (*dbService, error) {
-	var (
-		queries = map[string]string{
-			"status": ko.MustString("metrics.database.status"),
+	// Discover the hosts from the Prometheus config if none are listed, or
+	// if jobs to discover them from are.
+	if jobs := ko.Strings(section + ".jobs"); discovery == nil && prom != nil && (len(hosts) == 0 || len(jobs) > 0) {
+		discovered, discoveredLabels, err := discoverHosts(prom, jobs, hosts, ko.String(section+".location_map"))
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to discover %s hosts: %v", section, err)
 		}
-		hosts HostConfig
-	)
 
-	if err := ko.Unmarshal("metrics.database.hosts", &hosts); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal database hosts: %v", err)
+		// Labels in the config take precedence over the discovered ones.
+		hosts, labels = discovered, mergeLabels(discoveredLabels, labels)
+		logHosts(lo, section, hosts)
 	}
 
-	if len(hosts) == 0 {
-		return nil, fmt.Errorf("no hosts found in the config for database metrics")
+	if len(hosts) == 0 && discovery == nil {
+		return nil, nil, nil, nil, fmt.Errorf("no hosts found in the config for %s", section)
 	}
 
-	return &dbService{
-		hosts:   hosts,
-		queries: queries,
-	}, nil
-}
+	for _, m := range cat.Measures {
+		key := section + "." + m.Query
 
-// Load network metrics queries and hosts from the configuration
-func initNetworkSvc(ko *koanf.Koanf) (*networkService, error) {
-	var (
-		queries = map[string]string{
-			"packet_errors": ko.MustString("metrics.network.packet_errors"),
+		text := ko.String(key)
+		if text == "" {
+			if m.Required {
+				return nil, nil, nil, nil, fmt.Errorf("missing query %s", key)
+			}
+			continue
+		}
+
+		q, err := metrics.ParseQuery(key, text)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if q.Legacy() {
+			lo.Warn("query uses deprecated placeholders, use {{.Host}} instead", "query", key)
 		}
-		hosts HostConfig
-	)
 
-	if err := ko.Unmarshal("metrics.network.hosts", &hosts); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal network hosts: %v", err)
+		queries[m.Query] = q
 	}
 
-	if len(hosts) == 0 {
-		return nil, fmt.Errorf("no hosts found in the config for network metrics")
+	// Render the queries for every host to catch template errors early.
+	interval := categoryInterval(ko, section)
+	for id, host := range hosts {
+		if err := renderQueries(queries, id, host, labels[id], interval); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("location %d: %v", id, err)
+		}
+	}
+
+	return hosts, labels, queries, discovery, nil
+}
+
+// categoryEnabled reports whether the metrics category of a config section is
+// enabled, which it is unless `enabled` is set to false.
+func categoryEnabled(ko *koanf.Koanf, section string) bool {
+	return !ko.Exists(section+".enabled") || ko.Bool(section+".enabled")
+}
+
+// categoryInterval returns the sync interval of the metrics category of a
+// config section, which defaults to `app.sync_interval`.
+func categoryInterval(ko *koanf.Koanf, section string) time.Duration {
+	if d := ko.Duration(section + ".sync_interval"); d > 0 {
+		return d
 	}
 
-	return &networkService{
-		hosts:   hosts,
-		queries: queries,
+	return ko.MustDuration("app.sync_interval")
+}
+
+// initAPIDiscovery returns the discovery of the hosts of a category from the
+// Prometheus API. It returns nil if `discovery.source` isn't set.
+func initAPIDiscovery(ko *koanf.Koanf, section string, pinned HostConfig, labels map[int]map[string]string) (*apiDiscovery, error) {
+	key := section + ".discovery"
+
+	source := ko.String(key + ".source")
+	switch source {
+	case "":
+		return nil, nil
+	case discoveryTargets:
+	case discoveryLabelValues:
+		if ko.String(key+".host_label") == "" {
+			return nil, fmt.Errorf("%s.host_label is required with the %s source", key, source)
+		}
+	default:
+		return nil, fmt.Errorf("unknown %s.source: %s", key, source)
+	}
+
+	return &apiDiscovery{
+		section:  section,
+		category: strings.TrimPrefix(section, "metrics."),
+		source:   source,
+		sel: metrics.Selector{
+			Jobs:     ko.Strings(key + ".jobs"),
+			Matchers: ko.StringMap(key + ".matchers"),
+		},
+		hostLabel:     ko.String(key + ".host_label"),
+		locationLabel: ko.String(key + ".location_label"),
+		locationMap:   ko.String(key + ".location_map"),
+		pinned:        pinned,
+		labels:        labels,
 	}, nil
 }
 
-func initApplicationSvc(ko *koanf.Koanf) (*applicationService, error) {
-	var (
-		queries = map[string]string{
-			"failure_count": ko.MustString("metrics.application.failure_count"),
-			"throughput":    ko.MustString("metrics.application.throughput"),
+// renderQueries renders every query for a location and returns the first
+// error.
+func renderQueries(queries map[string]*metrics.Query, locationID int, host string, labels map[string]string, interval time.Duration) error {
+	for _, q := range queries {
+		if _, err := q.Render(metrics.QueryVars{
+			Host:       host,
+			LocationID: locationID,
+			Interval:   metrics.FormatDuration(interval),
+			Labels:     labels,
+		}); err != nil {
+			return err
 		}
-		hosts HostConfig
-	)
+	}
 
-	if err := ko.Unmarshal("metrics.application.hosts", &hosts); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal application hosts: %v", err)
+	return nil
+}
+
+// initStateStore initialises the store used to persist sequence IDs.
+func initStateStore(ko *koanf.Koanf) (state.Store, error) {
+	switch typ := ko.String("app.state_store"); typ {
+	case "", "memory":
+		return state.NewMemoryStore(), nil
+	case "file":
+		return state.NewFileStore(ko.MustString("app.state_path"))
+	default:
+		return nil, fmt.Errorf("unknown state store: %s", typ)
 	}
+}
 
-	if len(hosts) == 0 {
-		return nil, fmt.Errorf("no hosts found in the config for application metrics")
+// lockStateStore locks the state file of a file store, so that it can't be
+// reset while the sequence IDs are in use.
+func lockStateStore(store state.Store) error {
+	fs, ok := store.(*state.FileStore)
+	if !ok {
+		return nil
 	}
 
-	return &applicationService{
-		hosts:   hosts,
-		queries: queries,
-	}, nil
+	return fs.LockFile()
+}
+
+// initSpool initialises the spool for LAMA requests that could not be pushed.
+// It returns nil if the spool is disabled.
+func initSpool(ko *koanf.Koanf, lo *slog.Logger) (*spool.Spool, error) {
+	dir := ko.String("app.spool_dir")
+	if dir == "" {
+		return nil, nil
+	}
+
+	sp, err := spool.New(spool.Opts{
+		Dir:        dir,
+		MaxEntries: ko.Int("app.spool_max_entries"),
+		MaxAge:     ko.Duration("app.spool_max_age"),
+	}, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	return sp, nil
+}
+
+// initSpec loads the LAMA metrics spec from lama.nse.spec_path, or the
+// embedded one if it's not set.
+func initSpec(ko *koanf.Koanf, lo *slog.Logger) (*nse.Spec, error) {
+	path := ko.String("lama.nse.spec_path")
+	spec, err := nse.LoadSpec(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		path = "embedded"
+	}
+	lo.Info("loaded LAMA spec", "version", spec.Version, "path", path, "categories", strings.Join(spec.Names(), ", "))
+
+	return spec, nil
 }
 
-// initNSEManager initialises the NSE manager.
-func initNSEManager(ko *koanf.Koanf, lo *slog.Logger) (*nse.Manager, error) {
+// initDryRun returns the writer for the payloads in dry run mode, which is
+// stdout unless app.dry_run_output is set. It returns nil if dry run is
+// disabled.
+func initDryRun(ko *koanf.Koanf) (io.Writer, error) {
+	if !ko.Bool("app.dry_run") {
+		return nil, nil
+	}
+
+	path := ko.String("app.dry_run_output")
+	if path == "" {
+		return os.Stdout, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dry run output: %v", err)
+	}
+
+	return f, nil
+}
+
+// initAlerter initialises the alerter, which posts alerts to
+// app.alert_webhook if it's set.
+func initAlerter(ko *koanf.Koanf, lo *slog.Logger) *alerter {
+	return &alerter{
+		url:    ko.String("app.alert_webhook"),
+		client: &http.Client{Timeout: alertTimeout},
+		lo:     lo,
+	}
+}
+
+// initNSEManager initialises the NSE manager. In dry run mode, payloads are
+// written to dryRun and there's no login. Otherwise, the login happens in the
+// background in app.connectLAMA. Paused logins are alerted on.
+func initNSEManager(ko *koanf.Koanf, spec *nse.Spec, store state.Store, dryRun io.Writer, alerts *alerter, lo *slog.Logger) (*nse.Manager, error) {
+	// The alert names the credentials of the manager, which are replaced on
+	// reload.
+	var nseMgr *nse.Manager
 	nseMgr, err := nse.New(lo, nse.Opts{
 		URL:        ko.MustString("lama.nse.url"),
 		LoginID:    ko.MustString("lama.nse.login_id"),
@@ -211,23 +466,62 @@ func initNSEManager(ko *koanf.Koanf, lo *slog.Logger) (*nse.Manager, error) {
 		ExchangeID: ko.MustInt("lama.nse.exchange_id"),
 		Password:   ko.MustString("lama.nse.password"),
 		Timeout:    ko.MustDuration("lama.nse.timeout"),
+		Spec:       spec,
+		Store:      store,
+		DryRun:     dryRun,
+
+		BreakerThreshold: ko.Int("lama.nse.breaker_threshold"),
+		BreakerCooldown:  ko.Duration("lama.nse.breaker_cooldown"),
+		MaxLoginAttempts: ko.Int("lama.nse.max_login_attempts"),
+
+		TokenRefreshBefore: ko.Duration("lama.nse.token_refresh_before"),
+
+		OnLoginLocked: func(err error) {
+			loginID, memberID := nseMgr.Credentials()
+			alerts.send("lama_login_locked",
+				"LAMA rejected the credentials. Logins and pushes are paused until the credentials are changed or the config is reloaded",
+				map[string]string{"login_id": loginID, "member_id": memberID, "error": err.Error()})
+		},
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Attempt a login to NSE API.
-	if err := nseMgr.Login(); err != nil {
-		return nil, fmt.Errorf("failed to login to NSE API: %v", err)
+	if dryRun != nil {
+		lo.Warn("dry run enabled, skipping login and writing payloads instead of submitting them")
 	}
 
 	return nseMgr, nil
 }
 
-func initOpts(ko *koanf.Koanf) Opts {
-	return Opts{
-		MaxRetries:    ko.MustInt("app.max_retries"),
-		RetryInterval: ko.MustDuration("app.retry_interval"),
-		SyncInterval:  ko.MustDuration("app.sync_interval"),
+func initOpts(ko *koanf.Koanf, spec *nse.Spec) Opts {
+	opts := Opts{
+		MaxRetries:           ko.MustInt("app.max_retries"),
+		RetryInterval:        ko.MustDuration("app.retry_interval"),
+		RetryMaxInterval:     ko.Duration("app.retry_max_interval"),
+		RetryJitter:          ko.Float64("app.retry_jitter"),
+		SyncInterval:         ko.MustDuration("app.sync_interval"),
+		ReadyMaxMissedCycles: ko.Int("app.ready_max_missed_cycles"),
+		ResubmitRejected:     ko.Bool("app.resubmit_rejected"),
+		DiscoveryInterval:    ko.Duration("prometheus.discovery_interval"),
+		Categories:           make(map[string]CategoryOpts, len(spec.Categories)),
 	}
+
+	for _, name := range spec.Names() {
+		section := "metrics." + name
+		c := CategoryOpts{
+			Enabled:      categoryEnabled(ko, section),
+			SyncInterval: categoryInterval(ko, section),
+			SyncTimeout:  ko.Duration("app.sync_timeout"),
+		}
+
+		// By default, a cycle must finish before the next one is due.
+		if c.SyncTimeout <= 0 {
+			c.SyncTimeout = c.SyncInterval
+		}
+
+		opts.Categories[name] = c
+	}
+
+	return opts
 }
@@ -2,99 +2,211 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+	"github.com/zerodha/mii-lama/internal/spool"
+	"github.com/zerodha/mii-lama/internal/state"
 )
 
 var (
 	// Version of the build. This is injected at build-time.
 	buildString = "unknown"
-	exit        = func() { os.Exit(1) }
+	exit        = func() { os.Exit(exitFailure) }
+)
+
+// Exit codes of --once.
+const (
+	exitSuccess        = 0
+	exitFailure        = 1
+	exitPartialSuccess = 2
 )
 
 func main() {
 	// Initialise and load the config.
-	ko, err := initConfig("config.sample.toml", "MII_LAMA_")
+	ko, src, args, err := initConfig("config.sample.toml", "MII_LAMA_")
 	if err != nil {
 		panic(err.Error())
 	}
 
-	lo := initLogger(ko.MustString("app.log_level"))
+	lo := initLogger(ko.String("app.log_level"))
+
+	// Run one-off commands, if any.
+	if len(args) > 0 {
+		switch args[0] {
+		case "state":
+			err = runStateCmd(ko, args[1:])
+		case "mock-lama":
+			err = runMockLAMACmd(ko, lo)
+		case "check-config":
+			err = runCheckConfigCmd(ko, src.path)
+		default:
+			err = fmt.Errorf("unknown command: %s", args[0])
+		}
+
+		if err != nil {
+			lo.Error("command failed", "command", args[0], "error", err)
+			exit()
+		}
+		return
+	}
+
 	lo.Info("booting mii-lama version", "version", buildString)
 
-	// Initialise the metrics manager.
-	metricsMgr, err := initMetricsManager(ko)
-	if err != nil {
-		lo.Error("failed to init metrics manager", "error", err)
+	// Validate the whole config upfront and report every problem at once.
+	if problems := validateConfig(ko); len(problems) > 0 {
+		for _, p := range problems {
+			lo.Error("invalid config", "key", p.key, "error", p.msg)
+		}
 		exit()
 	}
 
-	// Load queries for hardware metrics.
-	hardwareSvc, err := inithardwareSvc(ko)
+	// Create a new context which is cancelled when `SIGINT`/`SIGTERM` is received.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Load the LAMA spec, which defines the metrics categories.
+	spec, err := initSpec(ko, lo)
 	if err != nil {
-		lo.Error("failed to init hardware service", "error", err)
+		lo.Error("failed to load LAMA spec", "error", err)
 		exit()
 	}
-	// Load queries for database metrics.
-	dbSvc, err := initDBSvc(ko)
+
+	// Initialise the metrics manager and load the queries and hosts of every
+	// category. These are built again on every config reload.
+	live, err := initLiveConfig(ko, spec, lo)
 	if err != nil {
-		lo.Error("failed to init db service", "error", err)
+		lo.Error("failed to init config", "error", err)
 		exit()
 	}
 
-	// Load queries for network metrics.
-	networkSvc, err := initNetworkSvc(ko)
+	// In dry run mode, payloads are written out instead of being submitted.
+	dryRun, err := initDryRun(ko)
 	if err != nil {
-		lo.Error("failed to init network service", "error", err)
+		lo.Error("failed to init dry run", "error", err)
 		exit()
 	}
 
-	// Load queries for application metrics.
-	applicationSvc, err := initApplicationSvc(ko)
-	if err != nil {
-		lo.Error("failed to init application service", "error", err)
-		exit()
+	// Initialise the store for persisting sequence IDs. A dry run must not
+	// touch the sequence IDs of real submissions, so it keeps them in memory.
+	var store state.Store = state.NewMemoryStore()
+	if dryRun == nil {
+		store, err = initStateStore(ko)
+		if err != nil {
+			lo.Error("failed to init state store", "error", err)
+			exit()
+		}
+		if err := lockStateStore(store); err != nil {
+			lo.Error("failed to lock state store", "error", err)
+			exit()
+		}
 	}
 
-	// Initialise the NSE manager.
-	nseMgr, err := initNSEManager(ko, lo)
+	// Initialise the NSE manager, which raises an alert if LAMA rejects the
+	// credentials.
+	alerts := initAlerter(ko, lo)
+	nseMgr, err := initNSEManager(ko, spec, store, dryRun, alerts, lo)
 	if err != nil {
 		lo.Error("failed to init nse manager", "error", err)
 		exit()
 	}
 
+	// Initialise the spool for requests that could not be pushed. Nothing
+	// fails to be pushed in a dry run.
+	var sp *spool.Spool
+	if dryRun == nil {
+		sp, err = initSpool(ko, lo)
+		if err != nil {
+			lo.Error("failed to init spool", "error", err)
+			exit()
+		}
+	}
+
 	// Init the app.
 	app := &App{
-		lo:             lo,
-		opts:           initOpts(ko),
-		metricsMgr:     metricsMgr,
-		nseMgr:         nseMgr,
-		hardwareSvc:    hardwareSvc,
-		dbSvc:          dbSvc,
-		networkSvc:     networkSvc,
-		applicationSvc: applicationSvc,
+		lo:         lo,
+		spec:       spec,
+		nseMgr:     nseMgr,
+		alerts:     alerts,
+		spool:      sp,
+		dryRun:     dryRun,
+		cycles:     newCycleTracker(),
+		rejections: newRejectionTracker(),
+		prometheus: newDependency(depPrometheus),
+		lama:       newDependency(depLAMA),
 	}
+	app.live.Store(live)
 
-	// Create a new context which is cancelled when `SIGINT`/`SIGTERM` is received.
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// Bail out if there's nothing to sync.
+	if len(app.enabledCategories()) == 0 {
+		lo.Error("all metrics categories are disabled")
+		exit()
+	}
+
+	// Run a single cycle and exit, if asked to. There's no point in waiting
+	// for Prometheus or LAMA to come up for a one-off run.
+	if ko.Bool("once.enabled") {
+		if err := app.connectPrometheus(ctx); err != nil {
+			lo.Error("failed to connect to prometheus", "error", err)
+			exit()
+		}
+		if err := app.connectLAMA(ctx); err != nil {
+			lo.Error("failed to login to NSE API", "error", err)
+			exit()
+		}
+		app.logCategories()
+		os.Exit(app.runOnce(ctx, ko.Strings("once.categories"), ko.Ints("once.locations")))
+	}
+
+	// Export the self-monitoring gauges.
+	registerGauges(app)
 
 	// Start the workers for fetching different metrics in the background.
 	var wg = &sync.WaitGroup{}
 
-	wg.Add(1)
-	go app.syncHWMetricsWorker(ctx, wg)
+	// Start the HTTP server for self-monitoring and health checks, if enabled.
+	if addr := ko.String("app.http_address"); addr != "" {
+		wg.Add(1)
+		go app.serveHTTP(ctx, wg, initHTTPServer(app, addr))
+	}
 
+	// Refresh the discovered hosts in the background.
 	wg.Add(1)
-	go app.syncDBMetricsWorker(ctx, wg)
+	go app.runDiscovery(ctx, wg)
 
+	// Reload the config on SIGHUP, and on changes to the config file if
+	// enabled.
 	wg.Add(1)
-	go app.syncNetworkMetricsWorker(ctx, wg)
+	go app.watchConfig(ctx, wg, src, ko.Bool("app.watch_config"))
+
+	// Connect to Prometheus, discovering hosts from its API, and log in to
+	// LAMA in the background. Until both are done, the app runs in a
+	// degraded state and isn't ready.
+	wg.Add(2)
+	go app.connect(ctx, wg, app.prometheus, app.connectPrometheus)
+	go app.connect(ctx, wg, app.lama, app.connectLAMA)
+
+	// Refresh the LAMA session token before it expires. There's no token in
+	// a dry run.
+	if dryRun == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nseMgr.RunTokenRefresh(ctx)
+		}()
+	}
 
+	// Start a worker for every enabled category once they're done.
 	wg.Add(1)
-	go app.syncApplicationMetricsWorker(ctx, wg)
+	go app.startWorkers(ctx, wg)
 
 	// Listen on the close channel indefinitely until a
 	// `SIGINT` or `SIGTERM` is received.
@@ -108,122 +220,223 @@ func main() {
 	app.lo.Info("shutting down")
 }
 
-func (app *App) syncHWMetricsWorker(ctx context.Context, wg *sync.WaitGroup) {
+// runWorker runs fn at every sync interval until ctx is cancelled. Every
+// cycle gets its own deadline so that a slow cycle can't pile up on the next.
+// A cycle for which fn returns an error is recorded as missed.
+func (app *App) runWorker(ctx context.Context, wg *sync.WaitGroup, name string, fn func(context.Context) error) {
 	defer wg.Done()
 
-	ticker := time.NewTicker(app.opts.SyncInterval)
+	interval := app.cfg().opts.Categories[name].SyncInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	app.lo.Info("Starting hardware metrics worker", "interval", app.opts.SyncInterval)
+	app.lo.Info("Starting metrics worker", "category", name, "interval", interval)
+
+	// Run the first cycle right away instead of a full interval later.
+	app.runCycle(ctx, name, fn)
+
 	for {
 		select {
 		case <-ticker.C:
-			data, err := app.fetchHWMetrics()
-			if err != nil {
-				app.lo.Error("Failed to fetch HW metrics", "error", err)
-				continue
-			}
+			app.runCycle(ctx, name, fn)
 
-			// Push to upstream LAMA APIs.
-			for locationID, hostData := range data {
-				if err := app.pushHWMetrics(locationID, app.hardwareSvc.hosts[locationID], hostData); err != nil {
-					app.lo.Error("Failed to push HW metrics to NSE", "locationID", locationID, "error", err)
-					continue
-				}
+			// Pick up a sync interval changed by a config reload.
+			if iv := app.cfg().opts.Categories[name].SyncInterval; iv != interval {
+				app.lo.Info("Changing metrics worker interval", "category", name, "interval", iv)
+				interval = iv
+				ticker.Reset(interval)
 			}
 		case <-ctx.Done():
-			app.lo.Info("Stopping HW metrics worker")
+			app.lo.Info("Stopping metrics worker", "category", name)
 			return
 		}
 	}
 }
 
-func (app *App) syncDBMetricsWorker(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+// runCycle runs a single sync cycle of a category with its own deadline.
+// Cycles are skipped while LAMA logins are paused, as nothing can be pushed.
+func (app *App) runCycle(ctx context.Context, name string, fn func(context.Context) error) error {
+	if app.nseMgr.LoginLocked() {
+		app.lo.Warn("skipping sync cycle, LAMA logins are paused until the credentials are changed or the config is reloaded", "category", name)
+		return nse.ErrLoginLocked
+	}
 
-	ticker := time.NewTicker(app.opts.SyncInterval)
-	defer ticker.Stop()
+	cycleCtx, cancel := context.WithTimeout(ctx, app.cfg().opts.Categories[name].SyncTimeout)
+	defer cancel()
 
-	app.lo.Info("Starting DB metrics worker", "interval", app.opts.SyncInterval)
-	for {
-		select {
-		case <-ticker.C:
-			data, err := app.fetchDBMetrics()
-			if err != nil {
-				app.lo.Error("Failed to fetch DB metrics", "error", err)
-				continue
-			}
+	err := fn(cycleCtx)
+	app.cycles.record(name, err)
 
-			// Push to upstream LAMA APIs.
-			for locationID, hostData := range data {
-				if err := app.pushDBMetrics(locationID, app.dbSvc.hosts[locationID], hostData); err != nil {
-					app.lo.Error("Failed to push DB metrics to NSE", "locationID", locationID, "error", err)
-					continue
-				}
-			}
-		case <-ctx.Done():
-			app.lo.Info("Stopping DB metrics worker")
-			return
+	return err
+}
+
+// syncs returns the sync function of every category.
+func (app *App) syncs() map[string]func(context.Context) error {
+	out := make(map[string]func(context.Context) error, len(app.spec.Categories))
+	for _, c := range app.spec.Categories {
+		name := c.Name
+		out[name] = func(ctx context.Context) error {
+			return app.syncMetrics(ctx, name)
 		}
 	}
+
+	return out
 }
 
-func (app *App) syncNetworkMetricsWorker(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+// enabledCategories returns the names of the enabled categories.
+func (app *App) enabledCategories() []string {
+	var out []string
+	for _, name := range app.spec.Names() {
+		if app.cfg().opts.Categories[name].Enabled {
+			out = append(out, name)
+		}
+	}
 
-	ticker := time.NewTicker(app.opts.SyncInterval)
-	defer ticker.Stop()
+	return out
+}
 
-	app.lo.Info("Starting network metrics worker", "interval", app.opts.SyncInterval)
-	for {
-		select {
-		case <-ticker.C:
-			data, err := app.fetchNetworkMetrics()
-			if err != nil {
-				app.lo.Error("Failed to fetch network metrics", "error", err)
-				continue
-			}
+// logCategories logs the enabled categories with their sync interval and
+// number of locations, and the disabled ones.
+func (app *App) logCategories() {
+	var (
+		cfg      = app.cfg()
+		enabled  []string
+		disabled []string
+	)
+	for _, name := range app.spec.Names() {
+		c := cfg.opts.Categories[name]
+		if !c.Enabled {
+			disabled = append(disabled, name)
+			continue
+		}
 
-			// Push to upstream LAMA APIs.
-			for locationID, hostData := range data {
-				if err := app.pushNetworkMetrics(locationID, app.networkSvc.hosts[locationID], hostData); err != nil {
-					app.lo.Error("Failed to push network metrics to NSE", "locationID", locationID, "error", err)
-					continue
+		h, _ := cfg.services[name].get()
+		enabled = append(enabled, fmt.Sprintf("%s (every %s, %d locations)", name, c.SyncInterval, len(h)))
+	}
+
+	app.lo.Info("metrics categories", "enabled", strings.Join(enabled, ", "), "disabled", strings.Join(disabled, ", "))
+}
+
+// runOnce runs a single sync cycle of the given categories (all enabled ones
+// if empty), limited to the given locations (all if empty), and returns the
+// exit code: exitSuccess if everything was pushed, exitFailure if nothing
+// was, and exitPartialSuccess otherwise.
+func (app *App) runOnce(ctx context.Context, categories []string, locations []int) int {
+	syncs := app.syncs()
+	services := app.cfg().services
+
+	if len(categories) == 0 {
+		categories = app.enabledCategories()
+	}
+	for _, c := range categories {
+		if _, ok := syncs[c]; !ok {
+			app.lo.Error("unknown category", "category", c)
+			return exitFailure
+		}
+		if !app.cfg().opts.Categories[c].Enabled {
+			app.lo.Error("category is disabled", "category", c)
+			return exitFailure
+		}
+	}
+
+	// Limit the hosts of every category, and the spooled entries that are
+	// replayed, to the given locations.
+	if len(locations) > 0 {
+		app.locations = locations
+		for _, svc := range services {
+			all, labels := svc.get()
+
+			filtered := make(HostConfig)
+			for id, host := range all {
+				if slices.Contains(locations, id) {
+					filtered[id] = host
 				}
 			}
-		case <-ctx.Done():
-			app.lo.Info("Stopping network metrics worker")
-			return
+			svc.set(filtered, labels)
 		}
 	}
+
+	var ok, failed, partial int
+	for _, c := range categories {
+		h, _ := services[c].get()
+		if len(h) == 0 {
+			app.lo.Warn("no locations to sync, skipping", "category", c, "locations", locations)
+			continue
+		}
+
+		app.lo.Info("running a single sync cycle", "category", c, "locations", len(h))
+
+		err := app.runCycle(ctx, c, syncs[c])
+		var pErr *pushError
+		switch {
+		case err == nil:
+			ok++
+		case errors.As(err, &pErr) && pErr.failed < pErr.total:
+			partial++
+		default:
+			failed++
+		}
+	}
+
+	app.lo.Info("finished single sync cycle", "succeeded", ok, "partially_succeeded", partial, "failed", failed)
+
+	switch {
+	case ok+partial+failed == 0:
+		app.lo.Error("nothing to sync", "categories", categories, "locations", locations)
+		return exitFailure
+	case partial == 0 && failed == 0:
+		return exitSuccess
+	case ok == 0 && partial == 0:
+		return exitFailure
+	}
+
+	return exitPartialSuccess
 }
 
-func (app *App) syncApplicationMetricsWorker(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+// pushError is returned by a sync cycle that failed to push the metrics of
+// some of its locations.
+type pushError struct {
+	category      string
+	failed, total int
+}
 
-	ticker := time.NewTicker(app.opts.SyncInterval)
-	defer ticker.Stop()
+func (e *pushError) Error() string {
+	return fmt.Sprintf("failed to push %s metrics for %d of %d locations", e.category, e.failed, e.total)
+}
 
-	app.lo.Info("Starting application metrics worker", "interval", app.opts.SyncInterval)
-	for {
-		select {
-		case <-ticker.C:
-			data, err := app.fetchApplicationMetrics()
-			if err != nil {
-				app.lo.Error("Failed to fetch application metrics", "error", err)
-				continue
-			}
+// syncMetrics runs a sync cycle of a category: it fetches the metrics of
+// every location, replays the requests spooled earlier and pushes the new
+// ones. Locations that fail to be fetched or pushed are counted as failed.
+func (app *App) syncMetrics(ctx context.Context, name string) error {
+	svc := app.cfg().services[name]
+	at := time.Now()
+	data, fetchErrs := app.fetchMetrics(ctx, svc, at)
+
+	// Replay requests spooled during an earlier outage first.
+	app.replaySpool(ctx, name)
+
+	// Locations whose metrics couldn't be fetched aren't pushed with
+	// measures missing. They're spooled, to be fetched as of this cycle and
+	// pushed when the spool is replayed.
+	failed := len(fetchErrs)
+	for locationID, err := range fetchErrs {
+		host := svc.host(locationID)
+		app.lo.Error("Failed to fetch metrics", "category", name, "host", host, "locationID", locationID, "error", err)
+		app.spoolFetch(name, host, locationID, at)
+	}
 
-			// Push to upstream LAMA APIs.
-			for locationID, hostData := range data {
-				if err := app.pushApplicationMetrics(locationID, app.applicationSvc.hosts[locationID], hostData); err != nil {
-					app.lo.Error("Failed to push application metrics to NSE", "locationID", locationID, "error", err)
-					continue
-				}
-			}
-		case <-ctx.Done():
-			app.lo.Info("Stopping application metrics worker")
-			return
+	// Push to upstream LAMA APIs.
+	for locationID, samples := range data {
+		if err := app.pushSamples(ctx, svc.cat, locationID, svc.host(locationID), samples); err != nil {
+			app.lo.Error("Failed to push metrics to NSE", "category", name, "locationID", locationID, "error", err)
+			failed++
+			continue
 		}
 	}
+
+	if failed > 0 {
+		return &pushError{category: name, failed: failed, total: len(data) + len(fetchErrs)}
+	}
+
+	return nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	vmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/zerodha/mii-lama/internal/nse"
+)
+
+// Self-monitoring metrics of mii-lama, exposed on /metrics by the optional
+// HTTP server.
+
+// registerGauges registers the gauges that are computed from the state of the
+// app when /metrics is scraped.
+func registerGauges(app *App) {
+	for _, ep := range app.spec.Names() {
+		ep := ep
+
+		vmetrics.NewGauge(fmt.Sprintf(`mii_lama_sequence_id{endpoint=%q}`, ep), func() float64 {
+			return float64(app.nseMgr.SeqStats()[ep].Next)
+		})
+		vmetrics.NewGauge(fmt.Sprintf(`mii_lama_sequence_id_gaps{endpoint=%q}`, ep), func() float64 {
+			return float64(app.nseMgr.SeqStats()[ep].Gaps)
+		})
+		vmetrics.NewGauge(fmt.Sprintf(`mii_lama_sequence_id_duplicates{endpoint=%q}`, ep), func() float64 {
+			return float64(app.nseMgr.SeqStats()[ep].Duplicates)
+		})
+
+		// 0=closed, 1=half-open, 2=open.
+		vmetrics.NewGauge(fmt.Sprintf(`mii_lama_circuit_breaker_state{endpoint=%q}`, ep), func() float64 {
+			return float64(app.nseMgr.BreakerState(ep))
+		})
+
+		if app.spool != nil {
+			vmetrics.NewGauge(fmt.Sprintf(`mii_lama_spool_depth{endpoint=%q}`, ep), func() float64 {
+				return float64(app.spool.Depth(ep))
+			})
+		}
+	}
+
+	// 1 once a dependency has been reached at startup, 0 until then.
+	for _, d := range []*dependency{app.prometheus, app.lama} {
+		d := d
+
+		vmetrics.NewGauge(fmt.Sprintf(`mii_lama_dependency_ready{dependency=%q}`, d.name), func() float64 {
+			if d.isReady() {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	// 1 while logins are paused after LAMA rejected the credentials.
+	vmetrics.NewGauge(`mii_lama_login_locked`, func() float64 {
+		if app.nseMgr.LoginLocked() {
+			return 1
+		}
+		return 0
+	})
+
+	// Age of the LAMA session token. -1 if there's no token.
+	vmetrics.NewGauge(`mii_lama_token_age_seconds`, func() float64 {
+		t := app.nseMgr.TokenIssuedAt()
+		if t.IsZero() {
+			return -1
+		}
+		return time.Since(t).Seconds()
+	})
+}
+
+// observeQuery records the outcome and duration of a Prometheus query.
+func observeQuery(category, host string, start time.Time, err error) {
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+
+	vmetrics.GetOrCreateCounter(fmt.Sprintf(`mii_lama_prometheus_queries_total{category=%q,host=%q,status=%q}`, category, host, status)).Inc()
+	vmetrics.GetOrCreateHistogram(fmt.Sprintf(`mii_lama_prometheus_query_duration_seconds{category=%q}`, category)).UpdateDuration(start)
+}
+
+// observePush records the outcome and duration of a single LAMA push
+// attempt. code is the LAMA response code, or 0 if there was no response.
+func observePush(endpoint string, code int, start time.Time) {
+	c := "none"
+	if code != 0 {
+		c = strconv.Itoa(code)
+	}
+
+	vmetrics.GetOrCreateCounter(fmt.Sprintf(`mii_lama_pushes_total{endpoint=%q,code=%q}`, endpoint, c)).Inc()
+	vmetrics.GetOrCreateHistogram(fmt.Sprintf(`mii_lama_push_duration_seconds{endpoint=%q}`, endpoint)).UpdateDuration(start)
+}
+
+// observePushSuccess records the time of the last successful push of an
+// endpoint for a location.
+func observePushSuccess(endpoint string, locationID int) {
+	vmetrics.GetOrCreateGauge(fmt.Sprintf(`mii_lama_last_push_success_timestamp_seconds{endpoint=%q,location=%q}`, endpoint, strconv.Itoa(locationID)), nil).Set(float64(time.Now().Unix()))
+}
+
+// observeRejected records a measure rejected by LAMA in a partially
+// successful response.
+func observeRejected(e nse.MeasureError) {
+	vmetrics.GetOrCreateCounter(fmt.Sprintf(`mii_lama_rejected_measures_total{endpoint=%q,location=%q,key=%q,code=%q}`,
+		e.Endpoint, strconv.Itoa(e.LocationID), e.ErrKey, strconv.Itoa(e.ErrCode))).Inc()
+}
+
+// observePushError records a failed LAMA push by the kind of error.
+func observePushError(endpoint string, err error) {
+	vmetrics.GetOrCreateCounter(fmt.Sprintf(`mii_lama_push_errors_total{endpoint=%q,type=%q}`, endpoint, nse.ErrorType(err))).Inc()
+}
+
+// observeRetry records a retry of a LAMA push.
+func observeRetry(endpoint string) {
+	vmetrics.GetOrCreateCounter(fmt.Sprintf(`mii_lama_push_retries_total{endpoint=%q}`, endpoint)).Inc()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+)
+
+// rejectionKey identifies a measure rejected by LAMA for the same reason.
+type rejectionKey struct {
+	endpoint string
+	key      string
+	code     int
+}
+
+// rejectionSummary is the summary of the rejections of a measure.
+type rejectionSummary struct {
+	Endpoint  string    `json:"endpoint"`
+	Key       string    `json:"key"`
+	Code      int       `json:"code"`
+	Desc      string    `json:"desc"`
+	Count     int       `json:"count"`
+	Locations []int     `json:"locations"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// rejectionTracker keeps a summary of the measures rejected by LAMA since
+// startup, so that recurring rejections stand out.
+type rejectionTracker struct {
+	sync.Mutex
+
+	keys map[rejectionKey]*rejectionSummary
+}
+
+func newRejectionTracker() *rejectionTracker {
+	return &rejectionTracker{keys: make(map[rejectionKey]*rejectionSummary)}
+}
+
+// record records a rejected measure.
+func (t *rejectionTracker) record(e nse.MeasureError) {
+	t.Lock()
+	defer t.Unlock()
+
+	k := rejectionKey{endpoint: e.Endpoint, key: e.ErrKey, code: e.ErrCode}
+	s, ok := t.keys[k]
+	if !ok {
+		s = &rejectionSummary{
+			Endpoint:  e.Endpoint,
+			Key:       e.ErrKey,
+			Code:      e.ErrCode,
+			FirstSeen: time.Now(),
+		}
+		t.keys[k] = s
+	}
+
+	s.Count++
+	s.Desc = e.ErrDesc
+	s.LastSeen = time.Now()
+	if !slices.Contains(s.Locations, e.LocationID) {
+		s.Locations = append(s.Locations, e.LocationID)
+		sort.Ints(s.Locations)
+	}
+}
+
+// summary returns the rejected measures, the most rejected first.
+func (t *rejectionTracker) summary() []rejectionSummary {
+	t.Lock()
+	defer t.Unlock()
+
+	out := make([]rejectionSummary, 0, len(t.keys))
+	for _, s := range t.keys {
+		c := *s
+		c.Locations = slices.Clone(s.Locations)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].LastSeen.After(out[j].LastSeen)
+	})
+
+	return out
+}
+
+// handleRejections lists the measures rejected by LAMA since startup, the
+// most rejected first.
+func (app *App) handleRejections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rejections": app.rejections.summary(),
+	})
+}
+
+// handleRejected reports the measures rejected in a partially successful
+// response and, if enabled, resubmits the ones whose values can be fixed.
+// Resubmitted requests aren't resubmitted again.
+func (app *App) handleRejected(ctx context.Context, endpoint, host string, req nse.MetricsReq, resp nse.MetricsResp, resubmit bool) {
+	rejected := resp.MeasureErrors(endpoint, req.LocationID)
+	if len(rejected) == 0 {
+		return
+	}
+
+	for _, e := range rejected {
+		app.lo.Warn("Measure rejected by NSE",
+			"endpoint", endpoint,
+			"host", host,
+			"locationID", req.LocationID,
+			"key", e.ErrKey,
+			"code", e.ErrCode,
+			"desc", e.ErrDesc,
+			"measure", e.Measure)
+		observeRejected(e)
+		app.rejections.record(e)
+	}
+
+	if !resubmit || !app.cfg().opts.ResubmitRejected {
+		return
+	}
+
+	cat, _ := app.spec.Category(endpoint)
+	fixed, ok := nse.FixMeasures(cat, req, rejected)
+	if !ok {
+		app.lo.Warn("No fix for the rejected measures, not resubmitting", "endpoint", endpoint, "host", host, "locationID", req.LocationID)
+		return
+	}
+
+	var n int
+	for _, p := range fixed.Payload {
+		n += len(p.MetricData)
+	}
+	app.lo.Info("Resubmitting fixed measures", "endpoint", endpoint, "host", host, "locationID", req.LocationID, "measures", n)
+
+	start := time.Now()
+	resp, err := app.nseMgr.Push(ctx, endpoint, host, fixed)
+	observePush(endpoint, resp.ResponseCode, start)
+	if err != nil {
+		app.lo.Error("Failed to resubmit fixed measures", "endpoint", endpoint, "host", host, "locationID", req.LocationID, "error", err)
+		return
+	}
+
+	app.handleRejected(ctx, endpoint, host, fixed, resp, false)
+}
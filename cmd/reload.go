@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/zerodha/mii-lama/internal/nse"
+)
+
+// reloadDebounce is the time to wait for changes to the config file to
+// settle before reloading it. Editors often write a file in several steps.
+const reloadDebounce = 500 * time.Millisecond
+
+// restartKeys returns the config keys that only take effect on a restart.
+func restartKeys(spec *nse.Spec) []string {
+	keys := []string{
+		"app.log_level",
+		"app.state_store",
+		"app.state_path",
+		"app.spool_dir",
+		"app.spool_max_entries",
+		"app.spool_max_age",
+		"app.http_address",
+		"app.watch_config",
+		"app.dry_run",
+		"app.dry_run_output",
+		"lama.nse.url",
+		"lama.nse.exchange_id",
+		"lama.nse.timeout",
+		"lama.nse.idle_timeout",
+		"lama.nse.breaker_threshold",
+		"lama.nse.breaker_cooldown",
+		"lama.nse.max_login_attempts",
+		"lama.nse.token_refresh_before",
+		"lama.nse.spec_path",
+		"app.alert_webhook",
+	}
+
+	// Workers are only started for the categories enabled at startup.
+	for _, name := range spec.Names() {
+		keys = append(keys, "metrics."+name+".enabled")
+	}
+
+	return keys
+}
+
+// watchConfig reloads the config on SIGHUP and, if watchFile is set, when the
+// config file changes, until ctx is cancelled.
+func (app *App) watchConfig(ctx context.Context, wg *sync.WaitGroup, src *configSource, watchFile bool) {
+	defer wg.Done()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if watchFile {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			app.lo.Error("failed to watch config file", "error", err)
+		} else {
+			defer w.Close()
+
+			// Watch the directory, as editors and Kubernetes replace the
+			// file instead of writing to it, which ends a watch on the file.
+			if err := w.Add(filepath.Dir(src.path)); err != nil {
+				app.lo.Error("failed to watch config file", "path", src.path, "error", err)
+			} else {
+				events, errs = w.Events, w.Errors
+				app.lo.Info("watching config file for changes", "path", src.path)
+			}
+		}
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			app.lo.Info("received SIGHUP, reloading config")
+			app.reload(ctx, src)
+
+		case ev := <-events:
+			// Kubernetes swaps the `..data` symlink of a mounted ConfigMap.
+			name := filepath.Base(ev.Name)
+			if (name == filepath.Base(src.path) || name == "..data") && !ev.Has(fsnotify.Chmod) {
+				debounce = time.After(reloadDebounce)
+			}
+
+		case err := <-errs:
+			app.lo.Error("error watching config file", "error", err)
+
+		case <-debounce:
+			debounce = nil
+			app.lo.Info("config file changed, reloading config", "path", src.path)
+			app.reload(ctx, src)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload reloads the config and logs the outcome.
+func (app *App) reload(ctx context.Context, src *configSource) {
+	if err := app.reloadConfig(ctx, src); err != nil {
+		app.lo.Error("failed to reload config, keeping the current one", "error", err)
+		return
+	}
+
+	app.lo.Info("config reloaded")
+}
+
+// reloadConfig loads the config again, validates it by initialising
+// everything that's built from it and swaps it in. If anything fails, the
+// current config stays in use. The LAMA session and sequence IDs are kept;
+// if the credentials changed, there's a login with the new ones first.
+func (app *App) reloadConfig(ctx context.Context, src *configSource) (err error) {
+	// The init functions panic on missing keys.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid config: %v", r)
+		}
+	}()
+
+	ko, err := src.load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	if problems := validateConfig(ko); len(problems) > 0 {
+		for _, p := range problems {
+			app.lo.Error("invalid config", "key", p.key, "error", p.msg)
+		}
+		return fmt.Errorf("%d problem(s) found in the config", len(problems))
+	}
+
+	cfg, err := initLiveConfig(ko, app.spec, app.lo)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			cfg.metricsMgr.Close()
+		}
+	}()
+
+	// Start discovery from the current hosts so that they keep their
+	// location IDs and only the changes are logged.
+	cur := app.cfg()
+	for name, to := range cfg.services {
+		if to.discovery != nil {
+			to.set(cur.services[name].get())
+		}
+	}
+
+	// Until Prometheus has been reached, app.connectPrometheus discovers the
+	// hosts with whichever config is current.
+	if app.prometheus.isReady() {
+		if err := app.discoverHostsFromAPI(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range restartKeys(app.spec) {
+		if !reflect.DeepEqual(cur.ko.Get(k), ko.Get(k)) {
+			app.lo.Warn("config change requires a restart to take effect", "key", k)
+		}
+	}
+
+	if err := app.nseMgr.UpdateCredentials(ctx,
+		ko.MustString("lama.nse.member_id"),
+		ko.MustString("lama.nse.login_id"),
+		ko.MustString("lama.nse.password")); err != nil {
+		return fmt.Errorf("failed to log in with the new credentials: %v", err)
+	}
+
+	// A reload resumes logins paused after the credentials were rejected,
+	// eg: once they've been fixed on LAMA's side. It's a single attempt, so
+	// reloading can't lock out the account either.
+	if app.dryRun == nil && (app.nseMgr.LoginLocked() || (!app.lama.isReady() && app.nseMgr.TokenIssuedAt().IsZero())) {
+		app.nseMgr.ResetLoginLock()
+		if err := app.nseMgr.Login(ctx); err != nil {
+			app.lo.Error("failed to log in to NSE API after reload", "error", err)
+		}
+	}
+
+	// A successful login gets LAMA out of the degraded state.
+	if !app.lama.isReady() && !app.nseMgr.TokenIssuedAt().IsZero() {
+		app.lama.markReady()
+		app.lo.Info("dependency ready", "dependency", app.lama.name)
+	}
+
+	// Syncs in progress finish with the replaced config. Its idle connections
+	// to Prometheus are closed now, and the rest once they've been idle for
+	// prometheus.idle_timeout.
+	app.live.Swap(cfg).metricsMgr.Close()
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+)
+
+// Names of the dependencies that mii-lama waits for at startup.
+const (
+	depPrometheus = "prometheus"
+	depLAMA       = "lama"
+)
+
+// dependency is an external service that mii-lama must have reached once
+// before it syncs anything. Until then, it runs in a degraded state.
+type dependency struct {
+	name  string
+	ready chan struct{}
+	once  sync.Once
+
+	mu       sync.Mutex
+	attempts int
+	lastErr  error
+}
+
+func newDependency(name string) *dependency {
+	return &dependency{name: name, ready: make(chan struct{})}
+}
+
+// markReady marks the dependency as ready. It's a no-op if it already is.
+func (d *dependency) markReady() {
+	d.once.Do(func() {
+		d.mu.Lock()
+		d.lastErr = nil
+		d.mu.Unlock()
+
+		close(d.ready)
+	})
+}
+
+// isReady reports whether the dependency is ready.
+func (d *dependency) isReady() bool {
+	select {
+	case <-d.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// failed records a failed attempt to reach the dependency.
+func (d *dependency) failed(err error) {
+	d.mu.Lock()
+	d.attempts++
+	d.lastErr = err
+	d.mu.Unlock()
+}
+
+// status returns the number of failed attempts to reach the dependency and
+// the last error.
+func (d *dependency) status() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.attempts, d.lastErr
+}
+
+// connect calls fn with backoff until it succeeds and then marks d as ready.
+// It gives up on errors that retrying can't fix, eg: rejected credentials,
+// in which case d stays unready until the config is reloaded.
+func (app *App) connect(ctx context.Context, wg *sync.WaitGroup, d *dependency, fn func(context.Context) error) {
+	defer wg.Done()
+
+	p := app.retryPolicy()
+	p.MaxAttempts = math.MaxInt
+	p.Retryable = func(err error) bool {
+		return !errors.Is(err, nse.ErrPermanent) && !errors.Is(err, nse.ErrLoginLocked)
+	}
+	p.OnRetry = func(attempt int, delay time.Duration, err error) {
+		app.lo.Warn("dependency unavailable, retrying", "dependency", d.name, "attempt", attempt, "retry_in", delay, "error", err)
+	}
+
+	err := p.Do(ctx, func(ctx context.Context) error {
+		// A config reload may have got there first.
+		if d.isReady() {
+			return nil
+		}
+
+		if err := fn(ctx); err != nil {
+			d.failed(err)
+			return err
+		}
+
+		return nil
+	})
+	switch {
+	case err == nil:
+		d.markReady()
+		app.lo.Info("dependency ready", "dependency", d.name)
+	case ctx.Err() != nil:
+	default:
+		app.lo.Error("giving up on dependency, fix the config and reload it", "dependency", d.name, "error", err)
+	}
+}
+
+// connectPrometheus checks that Prometheus is reachable and discovers the
+// hosts of the categories that discover them from its API.
+func (app *App) connectPrometheus(ctx context.Context) error {
+	cfg := app.cfg()
+	if err := cfg.metricsMgr.Ping(ctx); err != nil {
+		return err
+	}
+	if err := app.discoverHostsFromAPI(ctx, cfg); err != nil {
+		return err
+	}
+
+	// The config was reloaded in the meantime without discovering hosts,
+	// as Prometheus wasn't ready yet.
+	if app.cfg() != cfg {
+		return errors.New("config reloaded during discovery")
+	}
+
+	return nil
+}
+
+// connectLAMA logs in to LAMA. There's nothing to connect to in a dry run.
+func (app *App) connectLAMA(ctx context.Context) error {
+	if app.dryRun != nil {
+		return nil
+	}
+
+	return app.nseMgr.Login(ctx)
+}
+
+// waitReady waits until Prometheus and LAMA are ready. It returns false if
+// ctx is cancelled first.
+func (app *App) waitReady(ctx context.Context) bool {
+	for _, d := range []*dependency{app.prometheus, app.lama} {
+		if d.isReady() {
+			continue
+		}
+
+		app.lo.Info("waiting for dependency", "dependency", d.name)
+		select {
+		case <-d.ready:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// startWorkers starts a worker for every enabled category once Prometheus
+// and LAMA are ready.
+func (app *App) startWorkers(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if !app.waitReady(ctx) {
+		return
+	}
+
+	app.logCategories()
+
+	syncs := app.syncs()
+	for _, name := range app.enabledCategories() {
+		wg.Add(1)
+		go app.runWorker(ctx, wg, name, syncs[name])
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/zerodha/mii-lama/internal/metrics"
+	"github.com/zerodha/mii-lama/internal/nse"
+)
+
+// configProblem is a problem with a config key.
+type configProblem struct {
+	key string
+	msg string
+}
+
+func (p configProblem) String() string {
+	return p.key + ": " + p.msg
+}
+
+// configChecker collects the problems found in a config.
+type configChecker struct {
+	ko       *koanf.Koanf
+	problems []configProblem
+}
+
+// validateConfig checks the types and the values of the config keys, the
+// location IDs of every category and its queries, which are rendered for
+// every host and parsed as PromQL. It returns every problem found, in the
+// order of the keys.
+func validateConfig(ko *koanf.Koanf) []configProblem {
+	c := &configChecker{ko: ko}
+
+	c.oneOf("app.log_level", false, "debug", "info", "warn", "error")
+	c.integer("app.max_retries", true, 0)
+	c.duration("app.retry_interval", true, time.Millisecond)
+	c.duration("app.retry_max_interval", false, 0)
+	c.float("app.retry_jitter", 0, 1)
+	syncInterval := c.duration("app.sync_interval", true, time.Second)
+	c.duration("app.sync_timeout", false, 0)
+	if c.oneOf("app.state_store", false, "file", "memory") == "file" {
+		c.str("app.state_path", true)
+	}
+	c.str("app.spool_dir", false)
+	c.integer("app.spool_max_entries", false, 0)
+	c.duration("app.spool_max_age", false, 0)
+	if addr := c.str("app.http_address", false); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			c.add("app.http_address", "invalid address %q: %v", addr, err)
+		}
+	}
+	c.integer("app.ready_max_missed_cycles", false, 0)
+	c.boolean("app.dry_run")
+	c.str("app.dry_run_output", false)
+	c.boolean("app.watch_config")
+	c.boolean("app.resubmit_rejected")
+	if c.str("app.alert_webhook", false) != "" {
+		c.url("app.alert_webhook")
+	}
+
+	c.url("lama.nse.url")
+	c.str("lama.nse.login_id", true)
+	c.str("lama.nse.member_id", true)
+	c.str("lama.nse.password", true)
+	c.integer("lama.nse.exchange_id", true, 1)
+	c.duration("lama.nse.timeout", true, time.Millisecond)
+	c.duration("lama.nse.idle_timeout", false, 0)
+	c.integer("lama.nse.breaker_threshold", false, 0)
+	c.duration("lama.nse.breaker_cooldown", false, 0)
+	c.integer("lama.nse.max_login_attempts", false, 0)
+	if d := c.duration("lama.nse.token_refresh_before", false, 0); d >= nse.TokenTTL {
+		c.add("lama.nse.token_refresh_before", "must be less than the token's validity of %s", nse.TokenTTL)
+	}
+	spec, err := nse.LoadSpec(c.str("lama.nse.spec_path", false))
+	if err != nil {
+		c.add("lama.nse.spec_path", "%v", err)
+	}
+
+	c.url("prometheus.endpoint")
+	c.path("prometheus.query_path")
+	c.path("prometheus.query_range_path")
+	c.str("prometheus.username", false)
+	c.str("prometheus.password", false)
+	c.duration("prometheus.timeout", true, time.Millisecond)
+	c.duration("prometheus.idle_timeout", true, 0)
+	c.integer("prometheus.max_idle_conns", true, 0)
+	if step := c.duration("prometheus.range_step", false, 0); step > 0 && syncInterval > 0 && step >= syncInterval {
+		c.add("prometheus.range_step", "must be less than app.sync_interval (%s)", syncInterval)
+	}
+	c.boolean("prometheus.range_fallback")
+	c.duration("prometheus.discovery_interval", false, 0)
+
+	promConfig := c.str("prometheus.config_path", false)
+	if promConfig != "" {
+		if _, err := initPromConfig(ko); err != nil {
+			c.add("prometheus.config_path", "%v", err)
+		}
+	}
+
+	// The metrics sections can't be checked without a valid spec.
+	if spec == nil {
+		return c.problems
+	}
+
+	for _, cat := range spec.Categories {
+		c.section(cat, promConfig != "", syncInterval)
+	}
+	for _, name := range c.ko.MapKeys("metrics") {
+		if _, ok := spec.Category(name); !ok && categoryEnabled(c.ko, "metrics."+name) {
+			c.add("metrics."+name, "unknown category, the LAMA spec has %s", strings.Join(spec.Names(), ", "))
+		}
+	}
+
+	return c.problems
+}
+
+// section checks the hosts, labels, discovery and queries of a metrics
+// category.
+func (c *configChecker) section(cat nse.Category, promConfig bool, interval time.Duration) {
+	section := "metrics." + cat.Name
+
+	c.boolean(section + ".enabled")
+	if !categoryEnabled(c.ko, section) {
+		return
+	}
+	if d := c.duration(section+".sync_interval", false, time.Second); d > 0 {
+		interval = d
+	}
+
+	discovery := c.oneOf(section+".discovery.source", false, discoveryTargets, discoveryLabelValues)
+	if discovery == discoveryLabelValues {
+		c.str(section+".discovery.host_label", true)
+	}
+
+	// Discovered hosts take their location IDs from a label or the map.
+	hasMap := c.ko.String(section+".discovery.location_map") != ""
+	switch {
+	case discovery == discoveryTargets && !hasMap && c.ko.String(section+".discovery.location_label") == "":
+		c.add(section+".discovery", "set location_label or location_map for the location IDs of the discovered hosts")
+	case discovery == discoveryLabelValues && !hasMap:
+		c.add(section+".discovery.location_map", "required for the location IDs of the discovered hosts")
+	}
+	for _, key := range []string{section + ".location_map", section + ".discovery.location_map"} {
+		if path := c.str(key, false); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				c.add(key, "%v", err)
+			}
+		}
+	}
+
+	hosts := c.hosts(section)
+	if len(hosts) == 0 && discovery == "" && !promConfig {
+		c.add(section+".hosts", "no hosts, and neither discovery.source nor prometheus.config_path is set")
+	}
+
+	labels := make(map[int]map[string]string)
+	if c.ko.Exists(section + ".labels") {
+		if err := c.ko.Unmarshal(section+".labels", &labels); err != nil {
+			c.add(section+".labels", "must be tables of labels keyed by location ID: %v", err)
+		}
+	}
+
+	// Labels of locations that aren't listed are only used by discovered
+	// hosts.
+	if discovery == "" && !promConfig {
+		ids := make([]int, 0, len(labels))
+		for id := range labels {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			if _, ok := hosts[id]; !ok {
+				c.add(fmt.Sprintf("%s.labels.%d", section, id), "there's no host with location ID %d", id)
+			}
+		}
+	}
+
+	// Render the queries for the listed hosts, or for a placeholder one if
+	// they're all discovered.
+	renderHosts := hosts
+	if len(renderHosts) == 0 {
+		renderHosts = HostConfig{1: "example"}
+	}
+	ids := make([]int, 0, len(renderHosts))
+	for id := range renderHosts {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, m := range cat.Measures {
+		key := section + "." + m.Query
+
+		text := c.str(key, false)
+		if text == "" {
+			if m.Required {
+				c.add(key, "missing query")
+			}
+			continue
+		}
+
+		if strings.Contains(text, "{{") && strings.Contains(text, "%s") {
+			c.add(key, "mixes %%s with template actions, %%s is only replaced in queries without them. Use {{.Host}}")
+			continue
+		}
+
+		q, err := metrics.ParseQuery(key, text)
+		if err != nil {
+			c.add(key, "%v", err)
+			continue
+		}
+
+		for _, id := range ids {
+			query, err := q.Render(metrics.QueryVars{
+				Host:       renderHosts[id],
+				LocationID: id,
+				Interval:   metrics.FormatDuration(interval),
+				Labels:     labels[id],
+			})
+			if err != nil {
+				c.add(key, "location %d: %v", id, err)
+				break
+			}
+
+			if _, err := parser.ParseExpr(query); err != nil {
+				c.add(key, "invalid PromQL for location %d: %v", id, err)
+				break
+			}
+		}
+	}
+}
+
+// hosts checks the location IDs and hosts of a category and returns the
+// valid ones.
+func (c *configChecker) hosts(section string) HostConfig {
+	key := section + ".hosts"
+	if !c.ko.Exists(key) {
+		return nil
+	}
+
+	raw, ok := c.ko.Get(key).(map[string]interface{})
+	if !ok {
+		c.add(key, "must be a table of hosts keyed by location ID")
+		return nil
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var (
+		hosts  = make(HostConfig, len(raw))
+		byHost = make(map[string]int, len(raw))
+	)
+	for _, k := range keys {
+		id, err := strconv.Atoi(k)
+		if err != nil || id < 1 {
+			c.add(key+"."+k, "location ID must be a positive integer")
+			continue
+		}
+
+		host, ok := raw[k].(string)
+		if !ok || host == "" {
+			c.add(key+"."+k, "host must be a non-empty string")
+			continue
+		}
+
+		if h, ok := hosts[id]; ok {
+			c.add(key+"."+k, "location ID %d is already assigned to %s", id, h)
+			continue
+		}
+		if other, ok := byHost[host]; ok {
+			c.add(key+"."+k, "host %s is already assigned to location %d", host, other)
+			continue
+		}
+
+		hosts[id] = host
+		byHost[host] = id
+	}
+
+	return hosts
+}
+
+func (c *configChecker) add(key, format string, args ...interface{}) {
+	c.problems = append(c.problems, configProblem{key: key, msg: fmt.Sprintf(format, args...)})
+}
+
+// str checks that a key, if set, is a string and returns it.
+func (c *configChecker) str(key string, required bool) string {
+	if !c.ko.Exists(key) {
+		if required {
+			c.add(key, "missing")
+		}
+		return ""
+	}
+
+	v, ok := c.ko.Get(key).(string)
+	if !ok {
+		c.add(key, "must be a string")
+		return ""
+	}
+	if v == "" && required {
+		c.add(key, "must not be empty")
+	}
+
+	return v
+}
+
+// oneOf checks that a key, if set, is one of the given values. An empty
+// string is allowed if the key isn't required.
+func (c *configChecker) oneOf(key string, required bool, values ...string) string {
+	v := c.str(key, required)
+	if v == "" {
+		return ""
+	}
+
+	if !slices.Contains(values, v) {
+		c.add(key, "must be one of %s", strings.Join(values, ", "))
+		return ""
+	}
+
+	return v
+}
+
+// url checks that a required key is an absolute HTTP(S) URL.
+func (c *configChecker) url(key string) {
+	v := c.str(key, true)
+	if v == "" {
+		return
+	}
+
+	u, err := url.Parse(v)
+	if err != nil {
+		c.add(key, "invalid URL: %v", err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.add(key, "must be an http:// or https:// URL")
+	}
+}
+
+// path checks that a required key is a URL path.
+func (c *configChecker) path(key string) {
+	if v := c.str(key, true); v != "" && !strings.HasPrefix(v, "/") {
+		c.add(key, "must start with /")
+	}
+}
+
+// integer checks that a key, if set, is an integer of at least min.
+// Environment variables are strings, so numeric strings are allowed.
+func (c *configChecker) integer(key string, required bool, min int) int {
+	if !c.ko.Exists(key) {
+		if required {
+			c.add(key, "missing")
+		}
+		return 0
+	}
+
+	var n int
+	switch v := c.ko.Get(key).(type) {
+	case int64:
+		n = int(v)
+	case string:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.add(key, "must be an integer")
+			return 0
+		}
+		n = i
+	default:
+		c.add(key, "must be an integer")
+		return 0
+	}
+
+	if n < min {
+		c.add(key, "must be at least %d", min)
+	}
+
+	return n
+}
+
+// float checks that a key, if set, is a number between min and max.
+func (c *configChecker) float(key string, min, max float64) {
+	if !c.ko.Exists(key) {
+		return
+	}
+
+	var f float64
+	switch v := c.ko.Get(key).(type) {
+	case float64:
+		f = v
+	case int64:
+		f = float64(v)
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			c.add(key, "must be a number")
+			return
+		}
+		f = n
+	default:
+		c.add(key, "must be a number")
+		return
+	}
+
+	if f < min || f > max {
+		c.add(key, "must be between %g and %g", min, max)
+	}
+}
+
+// boolean checks that a key, if set, is a boolean.
+func (c *configChecker) boolean(key string) {
+	if !c.ko.Exists(key) {
+		return
+	}
+
+	switch v := c.ko.Get(key).(type) {
+	case bool:
+	case string:
+		if _, err := strconv.ParseBool(v); err != nil {
+			c.add(key, "must be true or false")
+		}
+	default:
+		c.add(key, "must be true or false")
+	}
+}
+
+// duration checks that a key, if set, is a duration such as "5m" of at
+// least min, and returns it.
+func (c *configChecker) duration(key string, required bool, min time.Duration) time.Duration {
+	if !c.ko.Exists(key) {
+		if required {
+			c.add(key, "missing")
+		}
+		return 0
+	}
+
+	v, ok := c.ko.Get(key).(string)
+	if !ok {
+		c.add(key, "must be a duration string, eg: 30s, 5m")
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		c.add(key, "invalid duration %q, eg: 30s, 5m", v)
+		return 0
+	}
+
+	if d < min || d < 0 {
+		c.add(key, "must be at least %s", min)
+	}
+
+	return d
+}
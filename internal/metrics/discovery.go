@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	targetsPath     = "/api/v1/targets"
+	labelValuesPath = "/api/v1/label/%s/values"
+)
+
+// Selector selects the series or targets to discover hosts from.
+type Selector struct {
+	// Jobs are the job names to match. Any job if empty.
+	Jobs []string
+
+	// Matchers are label name and value pairs that must all match.
+	Matchers map[string]string
+}
+
+type targetsResp struct {
+	Status string `json:"status"`
+	Data   struct {
+		ActiveTargets []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"activeTargets"`
+	} `json:"data"`
+}
+
+type labelValuesResp struct {
+	Status string   `json:"status"`
+	Data   []string `json:"data"`
+}
+
+// Targets returns the labels of the active scrape targets that match sel, in
+// the order returned by Prometheus.
+func (m *Manager) Targets(ctx context.Context, sel Selector) ([]map[string]string, error) {
+	var r targetsResp
+	if err := m.do(ctx, targetsPath, url.Values{"state": {"active"}}, &r); err != nil {
+		return nil, err
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("targets request failed with status %s", r.Status)
+	}
+
+	var out []map[string]string
+	for _, t := range r.Data.ActiveTargets {
+		if sel.matches(t.Labels) {
+			out = append(out, t.Labels)
+		}
+	}
+
+	return out, nil
+}
+
+// LabelValues returns the sorted values of a label across the series that
+// match sel.
+func (m *Manager) LabelValues(ctx context.Context, label string, sel Selector) ([]string, error) {
+	params := url.Values{}
+	if s := sel.String(); s != "" {
+		params.Set("match[]", s)
+	}
+
+	var r labelValuesResp
+	if err := m.do(ctx, fmt.Sprintf(labelValuesPath, url.PathEscape(label)), params, &r); err != nil {
+		return nil, err
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("label values request failed with status %s", r.Status)
+	}
+
+	sort.Strings(r.Data)
+
+	return r.Data, nil
+}
+
+// String returns sel as a PromQL series selector, eg: {job=~"a|b",env="prod"}.
+// It's empty if sel matches everything.
+func (sel Selector) String() string {
+	var parts []string
+	if len(sel.Jobs) > 0 {
+		jobs := make([]string, len(sel.Jobs))
+		for i, j := range sel.Jobs {
+			jobs[i] = regexp.QuoteMeta(j)
+		}
+		parts = append(parts, "job=~"+strconv.Quote(strings.Join(jobs, "|")))
+	}
+
+	names := make([]string, 0, len(sel.Matchers))
+	for k := range sel.Matchers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		parts = append(parts, k+"="+strconv.Quote(sel.Matchers[k]))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (sel Selector) matches(labels map[string]string) bool {
+	if len(sel.Jobs) > 0 && !slices.Contains(sel.Jobs, labels["job"]) {
+		return false
+	}
+
+	for k, v := range sel.Matchers {
+		if labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
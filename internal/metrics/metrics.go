@@ -1,9 +1,11 @@
 package metrics
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -13,12 +15,21 @@ import (
 type Opts struct {
 	Endpoint        string
 	QueryPath       string
+	QueryRangePath  string
 	Username        string
 	Password        string
 	IdleConnTimeout time.Duration
 	Timeout         time.Duration
 	MaxIdleConns    int
 	DefaultHosts    []string
+
+	// RangeStep is the resolution of range queries. If it's 0, range
+	// queries are disabled and QuerySamples falls back to an instant query.
+	RangeStep time.Duration
+
+	// RangeFallback makes QuerySamples fall back to an instant query when
+	// a range query fails or returns no samples.
+	RangeFallback bool
 }
 
 type Manager struct {
@@ -33,6 +44,7 @@ type PrometheusResponse struct {
 		Result     []struct {
 			Metric map[string]string `json:"metric"`
 			Value  []interface{}     `json:"value"`
+			Values [][]interface{}   `json:"values"`
 		} `json:"result"`
 	} `json:"data"`
 	Stats struct {
@@ -56,14 +68,20 @@ func NewManager(opts Opts) *Manager {
 	}
 }
 
+// Close closes the idle connections to Prometheus. Requests in flight are
+// unaffected, and the manager can still be used.
+func (m *Manager) Close() {
+	m.client.CloseIdleConnections()
+}
+
 // Ping queries the Prometheus HTTP API and checks if the server is up.
-func (m *Manager) Ping() error {
+func (m *Manager) Ping(ctx context.Context) error {
 	var (
 		endpoint = m.opts.Endpoint + "/api/v1/status/tsdb"
 	)
 
 	// Create a new request using http
-	req, err := http.NewRequest("GET", endpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create new HTTP request: %v", err)
 	}
@@ -88,16 +106,112 @@ func (m *Manager) Ping() error {
 	return nil
 }
 
-// Query queries the Prometheus HTTP API and returns the metric value.
-func (m *Manager) Query(query string) (float64, error) {
-	var (
-		root_url = m.opts.Endpoint + m.opts.QueryPath
-		h        = http.Header{}
-		params   = url.Values{}
-	)
+// Query queries the Prometheus HTTP API and returns the metric value at the
+// given time.
+func (m *Manager) Query(ctx context.Context, query string, at time.Time) (float64, error) {
+	params := url.Values{}
+	params.Add("query", query)
+	params.Add("time", strconv.FormatInt(at.Unix(), 10))
+
+	promResp, err := m.get(ctx, m.opts.QueryPath, params)
+	if err != nil {
+		return 0, err
+	}
 
+	// Check if the response contains any metrics.
+	if len(promResp.Data.Result) == 0 {
+		return 0, fmt.Errorf("response contains no result data")
+	}
+
+	// Extract the second entry of the "value" field.
+	if len(promResp.Data.Result[0].Value) > 1 {
+		return parseValue(promResp.Data.Result[0].Value[1])
+	} else {
+		return 0, fmt.Errorf("response contains no 'value' field")
+	}
+}
+
+// QueryRange queries the Prometheus HTTP range query API and returns the
+// samples of the first series between start and end at the given step.
+// NaN samples are skipped.
+func (m *Manager) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) ([]float64, error) {
+	params := url.Values{}
 	params.Add("query", query)
-	params.Add("time", strconv.FormatInt(time.Now().Unix(), 10))
+	params.Add("start", strconv.FormatInt(start.Unix(), 10))
+	params.Add("end", strconv.FormatInt(end.Unix(), 10))
+	params.Add("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	promResp, err := m.get(ctx, m.opts.QueryRangePath, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the response contains any metrics.
+	if len(promResp.Data.Result) == 0 {
+		return nil, fmt.Errorf("response contains no result data")
+	}
+
+	samples := make([]float64, 0, len(promResp.Data.Result[0].Values))
+	for _, v := range promResp.Data.Result[0].Values {
+		if len(v) < 2 {
+			return nil, fmt.Errorf("response contains a malformed sample")
+		}
+
+		value, err := parseValue(v[1])
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(value) {
+			continue
+		}
+
+		samples = append(samples, value)
+	}
+
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("response contains no samples")
+	}
+
+	return samples, nil
+}
+
+// QuerySamples returns the samples of a metric over the window ending at the
+// given time using a range query. If range queries are disabled, or if the
+// range query fails and the fallback is enabled, the instant value is
+// returned as a single sample.
+func (m *Manager) QuerySamples(ctx context.Context, query string, window time.Duration, at time.Time) ([]float64, error) {
+	if m.opts.RangeStep > 0 {
+		samples, err := m.QueryRange(ctx, query, at.Add(-window), at, m.opts.RangeStep)
+		if err == nil || !m.opts.RangeFallback || ctx.Err() != nil {
+			return samples, err
+		}
+	}
+
+	value, err := m.Query(ctx, query, at)
+	if err != nil {
+		return nil, err
+	}
+
+	return []float64{value}, nil
+}
+
+// get sends a GET request to a Prometheus API path and decodes the response.
+func (m *Manager) get(ctx context.Context, path string, params url.Values) (PrometheusResponse, error) {
+	var promResp PrometheusResponse
+	if err := m.do(ctx, path, params, &promResp); err != nil {
+		return PrometheusResponse{}, err
+	}
+
+	return promResp, nil
+}
+
+// do makes a GET request to a Prometheus API and decodes the JSON response
+// into out.
+func (m *Manager) do(ctx context.Context, path string, params url.Values, out interface{}) error {
+	var (
+		reqUrl = m.opts.Endpoint + path + "?" + params.Encode()
+		h      = http.Header{}
+	)
 
 	// Set the username and password for basic authentication.
 	if m.opts.Username != "" && m.opts.Password != "" {
@@ -105,54 +219,47 @@ func (m *Manager) Query(query string) (float64, error) {
 		h.Set("Authorization", "Basic "+auth)
 	}
 
-	reqUrl := root_url + "?" + params.Encode()
-
-	req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create new HTTP request: %v", err)
+		return fmt.Errorf("failed to create new HTTP request: %v", err)
 	}
 
 	req.Header = h
 
 	resp, err := m.client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("HTTP request failed: %v", err)
+		return fmt.Errorf("HTTP request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// Check the status code of the response.
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("HTTP request returned a non-200 status code (%d)", resp.StatusCode)
+		return fmt.Errorf("HTTP request returned a non-200 status code (%d)", resp.StatusCode)
 	}
 
-	// Unmarshal the JSON response into a PrometheusResponse struct
-	var promResp PrometheusResponse
-	if err = json.NewDecoder(resp.Body).Decode(&promResp); err != nil {
-		return 0, fmt.Errorf("failed to unmarshal the response body: %v", err)
-	}
-
-	// Check if the response contains any metrics.
-	if len(promResp.Data.Result) == 0 {
-		return 0, fmt.Errorf("response contains no result data")
+	// Unmarshal the JSON response.
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to unmarshal the response body: %v", err)
 	}
 
-	// Extract the second entry of the "value" field.
-	if len(promResp.Data.Result[0].Value) > 1 {
-		value, ok := promResp.Data.Result[0].Value[1].(string)
-		if !ok {
-			return 0, fmt.Errorf("value in the response is not a string")
-		}
+	return nil
+}
 
-		// Convert string to float64.
-		floatValue, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return 0, fmt.Errorf("failed to convert response value from string to float64: %v", err)
-		}
+// parseValue converts a sample value, which Prometheus encodes as a string,
+// to float64.
+func parseValue(v interface{}) (float64, error) {
+	value, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("value in the response is not a string")
+	}
 
-		return floatValue, nil
-	} else {
-		return 0, fmt.Errorf("response contains no 'value' field")
+	// Convert string to float64.
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert response value from string to float64: %v", err)
 	}
+
+	return floatValue, nil
 }
 
 // generateBasicAuthHeader generates a basic authentication header given a username and password.
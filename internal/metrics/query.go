@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// QueryVars are the variables available to query templates.
+type QueryVars struct {
+	// Host is the host of the location, eg: {{.Host}}.
+	Host string
+
+	// LocationID is the LAMA location ID of the host, eg: {{.LocationID}}.
+	LocationID int
+
+	// Interval is the sync interval as a PromQL duration, eg: [{{.Interval}}].
+	Interval string
+
+	// Labels are the labels configured for the location, eg: {{.Labels.dc}}.
+	Labels map[string]string
+}
+
+// Query is a PromQL query written as a text/template.
+type Query struct {
+	name   string
+	tpl    *template.Template
+	legacy bool
+}
+
+// ParseQuery parses a query template. For backwards compatibility, a query
+// without any template action has every `%s` replaced with {{.Host}}.
+func ParseQuery(name, text string) (*Query, error) {
+	q := &Query{name: name}
+
+	if !strings.Contains(text, "{{") && strings.Contains(text, "%s") {
+		text = strings.ReplaceAll(text, "%s", "{{.Host}}")
+		q.legacy = true
+	}
+
+	tpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query template %s: %v", name, err)
+	}
+	q.tpl = tpl
+
+	return q, nil
+}
+
+// Legacy reports whether the query uses the deprecated `%s` placeholders.
+func (q *Query) Legacy() bool {
+	return q.legacy
+}
+
+// Render renders the query with the given variables.
+func (q *Query) Render(vars QueryVars) (string, error) {
+	if vars.Labels == nil {
+		vars.Labels = map[string]string{}
+	}
+
+	var b bytes.Buffer
+	if err := q.tpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("failed to render query %s: %v", q.name, err)
+	}
+
+	return b.String(), nil
+}
+
+// FormatDuration formats d as a PromQL duration, eg: 5m.
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "0s"
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
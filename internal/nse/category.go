@@ -0,0 +1,111 @@
+package nse
+
+import (
+	"time"
+
+	"github.com/zerodha/mii-lama/pkg/models"
+)
+
+// ValueKind is how the value of a measure is reported to LAMA.
+type ValueKind int
+
+const (
+	// Simple measures are reported as their latest sample, fetched with an
+	// instant query.
+	Simple ValueKind = iota
+
+	// Summary measures are reported as the min, max, avg and med of their
+	// samples over the last sync interval.
+	Summary
+)
+
+func (k ValueKind) String() string {
+	if k == Simple {
+		return kindSimple
+	}
+
+	return kindSummary
+}
+
+// NoPrecision is the precision of measures whose values aren't rounded.
+const NoPrecision = -1
+
+// Measure is a metric reported to LAMA in the payload of a category.
+type Measure struct {
+	// Key is the LAMA key of the measure.
+	Key string
+
+	// Query is the name of the measure's Prometheus query in the category's
+	// config section, and the key of its samples in models.Samples.
+	Query string
+
+	Kind ValueKind
+
+	// Precision is the number of decimal places that summary values are
+	// rounded to, and that rejected values are fixed to by FixMeasures. If
+	// it's NoPrecision, values aren't rounded.
+	Precision int
+
+	// Percent measures are percentages, and are clamped to 100 when fixed.
+	Percent bool
+
+	// Required measures must have a query. The rest are left out of the
+	// payload if they have none.
+	Required bool
+}
+
+// Category is a LAMA metrics category.
+type Category struct {
+	// Name is the name of the category in the config, logs and metrics. It's
+	// also the key under which its sequence IDs are persisted.
+	Name string
+
+	// Path is the path of the category's LAMA endpoint.
+	Path string
+
+	// Measures are reported in this order.
+	Measures []Measure
+}
+
+// round rounds v to the precision of the measure, if it has one.
+func (m Measure) round(v float64) float64 {
+	if m.Precision == NoPrecision {
+		return v
+	}
+
+	return round(v, m.Precision)
+}
+
+// Measure returns the measure with the given LAMA key.
+func (c Category) Measure(key string) (Measure, bool) {
+	for _, m := range c.Measures {
+		if m.Key == key {
+			return m, true
+		}
+	}
+
+	return Measure{}, false
+}
+
+// NewRequest builds a request with the measures of a category that have
+// samples, timestamped now. The sequence ID is assigned when the request is
+// pushed.
+func (mgr *Manager) NewRequest(cat Category, locationID int, samples models.Samples) MetricsReq {
+	data := make([]MetricData, 0, len(cat.Measures))
+	for _, m := range cat.Measures {
+		data = append(data, newMetricData(m, samples[m.Query]))
+	}
+
+	return MetricsReq{
+		MemberID:   mgr.memberID(),
+		ExchangeID: mgr.opts.ExchangeID,
+		LocationID: locationID,
+		Timestamp:  time.Now().Unix(),
+		Payload: []MetricPayload{
+			{
+				ApplicationID: 1,
+				MetricData:    present(data...),
+			},
+		},
+	}
+}
@@ -0,0 +1,123 @@
+package nse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/zerodha/mii-lama/internal/retry"
+)
+
+var (
+	// ErrTransport is returned when the LAMA API could not be reached or did
+	// not return a valid response, eg: network errors and 5xx responses.
+	ErrTransport = errors.New("LAMA API unreachable")
+
+	// ErrMalformedResponse is returned when a LAMA response can't be
+	// decoded. It's also an ErrTransport, as it's usually a proxy or the
+	// gateway answering with an error page.
+	ErrMalformedResponse = errors.New("malformed LAMA response")
+
+	// ErrPermanent is returned when LAMA rejects a request in a way that
+	// retrying the same request won't fix, eg: invalid credentials or an
+	// invalid payload. Every *ErrRejected is an ErrPermanent.
+	ErrPermanent = errors.New("rejected by LAMA")
+
+	// ErrTokenExpired is returned when LAMA rejected the session token as
+	// invalid or expired (801, 802) and a new one was obtained, so the same
+	// request can be pushed again right away.
+	ErrTokenExpired = errors.New("LAMA session token invalid or expired")
+
+	// ErrLoginLocked is returned when logins are paused after LAMA rejected
+	// the credentials, to keep the member account from being locked out.
+	// Nothing is pushed until the credentials are changed or the lock is
+	// reset.
+	ErrLoginLocked = errors.New("LAMA logins paused after rejected credentials")
+)
+
+// ErrSequenceMismatch is returned when LAMA rejected a request's sequence ID
+// (704). The endpoint's next sequence ID has been set to Expected, so the
+// same request can be pushed again.
+type ErrSequenceMismatch struct {
+	Expected int
+}
+
+func (e *ErrSequenceMismatch) Error() string {
+	return fmt.Sprintf("sequence ID mismatch, LAMA expects %d", e.Expected)
+}
+
+// ErrRejected is returned when LAMA rejected a login or a request with a
+// response code that retrying won't change. It matches ErrPermanent.
+type ErrRejected struct {
+	// HTTPStatus is the HTTP status of the response.
+	HTTPStatus int
+
+	// Code and Desc are the LAMA response code and description. Code is 0
+	// if the response had none.
+	Code int
+	Desc string
+
+	// Errors are the errors reported for individual measures, if any.
+	Errors []MetricError
+}
+
+func (e *ErrRejected) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("%v: HTTP %d", ErrPermanent, e.HTTPStatus)
+	}
+
+	return fmt.Sprintf("%v: HTTP %d, response code %d: %s", ErrPermanent, e.HTTPStatus, e.Code, e.Desc)
+}
+
+func (e *ErrRejected) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// IsRetryable reports whether a failed push or login is worth retrying:
+// transport failures, expired tokens, sequence ID mismatches and unknown
+// errors are.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrPermanent),
+		errors.Is(err, ErrLoginLocked),
+		errors.Is(err, retry.ErrOpen),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+
+	return true
+}
+
+// ErrorType returns a short name for the kind of a push or login error, eg:
+// for labelling metrics. It's empty if err is nil.
+func ErrorType(err error) string {
+	var (
+		seq *ErrSequenceMismatch
+		rej *ErrRejected
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrLoginLocked):
+		return "login_locked"
+	case errors.Is(err, retry.ErrOpen):
+		return "breaker_open"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	case errors.Is(err, ErrTokenExpired):
+		return "token_expired"
+	case errors.As(err, &seq):
+		return "sequence_mismatch"
+	case errors.Is(err, ErrMalformedResponse):
+		return "malformed_response"
+	case errors.Is(err, ErrTransport):
+		return "transport"
+	case errors.As(err, &rej), errors.Is(err, ErrPermanent):
+		return "rejected"
+	}
+
+	return "other"
+}
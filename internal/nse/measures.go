@@ -0,0 +1,165 @@
+package nse
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// MeasureError is a measure that LAMA rejected in a partially successful
+// (602) response. The rest of the request was accepted.
+type MeasureError struct {
+	Endpoint   string
+	LocationID int
+	MetricError
+}
+
+func (e MeasureError) Error() string {
+	return fmt.Sprintf("%s measure %q of location %d rejected with code %d: %s", e.Endpoint, e.ErrKey, e.LocationID, e.ErrCode, e.ErrDesc)
+}
+
+// MeasureErrors returns the measures rejected in a response to a request
+// for a location. It's empty unless the response is a partial success.
+func (r MetricsResp) MeasureErrors(endpoint string, locationID int) []MeasureError {
+	if r.ResponseCode != NSE_RESP_CODE_PARTIAL_SUCCESS {
+		return nil
+	}
+
+	out := make([]MeasureError, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		out = append(out, MeasureError{
+			Endpoint:    endpoint,
+			LocationID:  locationID,
+			MetricError: e,
+		})
+	}
+
+	return out
+}
+
+// fixes are the fixes of the known issues of rejected values.
+type fixes struct {
+	// precision rounds values to the precision of the measure.
+	precision bool
+
+	// bounds sets negative values to 0 and percentages above 100 to 100.
+	bounds bool
+
+	// order widens min and max to include avg and med.
+	order bool
+}
+
+// fixes returns the fixes for the issue LAMA reported for a rejected measure
+// in its errDesc. It's empty if the issue isn't a known one.
+func (e MeasureError) fixes() fixes {
+	desc := strings.ToLower(e.ErrDesc)
+
+	return fixes{
+		precision: strings.Contains(desc, "precision") || strings.Contains(desc, "decimal"),
+		bounds:    strings.Contains(desc, "range") || strings.Contains(desc, "negative") || strings.Contains(desc, "exceed"),
+		order:     strings.Contains(desc, "min") && strings.Contains(desc, "max"),
+	}
+}
+
+// FixMeasures returns a request with only the rejected measures of req to a
+// category, after fixing the issues LAMA reported for them: too many decimal
+// places, out of range values, or min and max that are out of order. Only
+// the issue in a measure's errDesc is fixed, and values are only rounded for
+// measures with a precision in the spec. Measures that have nothing to fix,
+// or that the category doesn't define, are left out, as they'd be rejected
+// again. It returns false if no measure was fixed. The timestamp is kept,
+// Push assigns a new sequence ID.
+func FixMeasures(cat Category, req MetricsReq, rejected []MeasureError) (MetricsReq, bool) {
+	type measure struct {
+		appID int
+		key   string
+	}
+	bad := make(map[measure]fixes, len(rejected))
+	for _, e := range rejected {
+		bad[measure{e.ApplicationID, e.ErrKey}] = e.fixes()
+	}
+
+	out := req
+	out.Payload = nil
+	for _, p := range req.Payload {
+		var data []MetricData
+		for _, d := range p.MetricData {
+			f, ok := bad[measure{p.ApplicationID, d.Key}]
+			if !ok {
+				continue
+			}
+
+			m, ok := cat.Measure(d.Key)
+			if !ok {
+				continue
+			}
+
+			if v, ok := fixValue(m, f, d.Value); ok {
+				data = append(data, MetricData{Key: d.Key, Value: v})
+			}
+		}
+
+		if len(data) > 0 {
+			out.Payload = append(out.Payload, MetricPayload{ApplicationID: p.ApplicationID, MetricData: data})
+		}
+	}
+
+	return out, len(out.Payload) > 0
+}
+
+// fixValue applies fixes to the value of a measure. It returns false if
+// there was nothing to fix.
+func fixValue(m Measure, f fixes, v interface{}) (interface{}, bool) {
+	switch val := v.(type) {
+	case float64:
+		fixed := fixNumber(m, f, val)
+		return fixed, fixed != val
+
+	case MetricValue:
+		fixed := MetricValue{
+			Min: fixNumber(m, f, val.Min),
+			Max: fixNumber(m, f, val.Max),
+			Avg: fixNumber(m, f, val.Avg),
+			Med: fixNumber(m, f, val.Med),
+		}
+		if f.order {
+			fixed.Min = math.Min(fixed.Min, math.Min(fixed.Avg, fixed.Med))
+			fixed.Max = math.Max(fixed.Max, math.Max(fixed.Avg, fixed.Med))
+		}
+
+		return fixed, fixed != val
+
+	case map[string]interface{}:
+		// Values of requests read back from the spool.
+		var mv MetricValue
+		for k, dst := range map[string]*float64{"min": &mv.Min, "max": &mv.Max, "avg": &mv.Avg, "med": &mv.Med} {
+			n, ok := val[k].(float64)
+			if !ok {
+				return v, false
+			}
+			*dst = n
+		}
+		return fixValue(m, f, mv)
+	}
+
+	return v, false
+}
+
+// fixNumber rounds v to the precision of a measure and clamps it to its
+// range, as required by f.
+func fixNumber(m Measure, f fixes, v float64) float64 {
+	if f.precision {
+		v = m.round(v)
+	}
+
+	if f.bounds {
+		if v < 0 {
+			v = 0
+		}
+		if m.Percent && v > 100 {
+			v = 100
+		}
+	}
+
+	return v
+}
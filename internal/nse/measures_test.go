@@ -0,0 +1,124 @@
+package nse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFixMeasures(t *testing.T) {
+	cat := Category{
+		Name: "test",
+		Measures: []Measure{
+			{Key: "count", Kind: Simple, Precision: NoPrecision},
+			{Key: "cpu", Kind: Summary, Precision: 2, Percent: true},
+			{Key: "uptime", Kind: Summary, Precision: 0},
+		},
+	}
+
+	tests := []struct {
+		name string
+		data []MetricData
+		errs []MetricError
+		want []MetricData
+	}{
+		{
+			name: "valid fractional value is left unchanged",
+			data: []MetricData{{Key: "count", Value: 12.3456}},
+			errs: []MetricError{{ErrKey: "count", ErrCode: 703, ErrDesc: "Invalid precision"}},
+		},
+		{
+			name: "valid fractional value out of range is left unchanged",
+			data: []MetricData{{Key: "count", Value: 12.3456}},
+			errs: []MetricError{{ErrKey: "count", ErrCode: 703, ErrDesc: "Value out of range"}},
+		},
+		{
+			name: "negative value out of range",
+			data: []MetricData{{Key: "count", Value: -1.5}},
+			errs: []MetricError{{ErrKey: "count", ErrCode: 703, ErrDesc: "Value out of range"}},
+			want: []MetricData{{Key: "count", Value: 0.0}},
+		},
+		{
+			name: "percentage out of range",
+			data: []MetricData{{Key: "cpu", Value: MetricValue{Min: 10, Max: 100.004, Avg: 50.123, Med: 40}}},
+			errs: []MetricError{{ErrKey: "cpu", ErrCode: 703, ErrDesc: "Value out of range"}},
+			want: []MetricData{{Key: "cpu", Value: MetricValue{Min: 10, Max: 100, Avg: 50.123, Med: 40}}},
+		},
+		{
+			name: "precision of a summary",
+			data: []MetricData{{Key: "cpu", Value: MetricValue{Min: 10.111, Max: 20.2, Avg: 15.155, Med: 15}}},
+			errs: []MetricError{{ErrKey: "cpu", ErrCode: 703, ErrDesc: "Too many decimal places"}},
+			want: []MetricData{{Key: "cpu", Value: MetricValue{Min: 10.11, Max: 20.2, Avg: 15.16, Med: 15}}},
+		},
+		{
+			name: "min and max out of order",
+			data: []MetricData{{Key: "uptime", Value: MetricValue{Min: 5, Max: 3, Avg: 4, Med: 4}}},
+			errs: []MetricError{{ErrKey: "uptime", ErrCode: 703, ErrDesc: "min is greater than max"}},
+			want: []MetricData{{Key: "uptime", Value: MetricValue{Min: 4, Max: 4, Avg: 4, Med: 4}}},
+		},
+		{
+			name: "spooled summary",
+			data: []MetricData{{Key: "cpu", Value: map[string]interface{}{"min": -1.0, "max": 2.0, "avg": 1.0, "med": 1.0}}},
+			errs: []MetricError{{ErrKey: "cpu", ErrCode: 703, ErrDesc: "Negative value"}},
+			want: []MetricData{{Key: "cpu", Value: MetricValue{Min: 0, Max: 2, Avg: 1, Med: 1}}},
+		},
+		{
+			name: "unknown issue",
+			data: []MetricData{{Key: "uptime", Value: MetricValue{Min: -1.5, Max: 3, Avg: 1, Med: 1}}},
+			errs: []MetricError{{ErrKey: "uptime", ErrCode: 705, ErrDesc: "Measure not expected"}},
+		},
+		{
+			name: "only rejected measures are resubmitted",
+			data: []MetricData{{Key: "count", Value: -2.0}, {Key: "uptime", Value: MetricValue{Min: -1, Max: 3, Avg: 1, Med: 1}}},
+			errs: []MetricError{{ErrKey: "count", ErrCode: 703, ErrDesc: "Value out of range"}},
+			want: []MetricData{{Key: "count", Value: 0.0}},
+		},
+		{
+			name: "measure not in the category",
+			data: []MetricData{{Key: "other", Value: -2.0}},
+			errs: []MetricError{{ErrKey: "other", ErrCode: 703, ErrDesc: "Value out of range"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := MetricsReq{
+				LocationID: 1,
+				Timestamp:  1700000000,
+				Payload:    []MetricPayload{{ApplicationID: 1, MetricData: tt.data}},
+			}
+
+			var rejected []MeasureError
+			for _, e := range tt.errs {
+				e.ApplicationID = 1
+				rejected = append(rejected, MeasureError{Endpoint: cat.Name, LocationID: 1, MetricError: e})
+			}
+
+			got, ok := FixMeasures(cat, req, rejected)
+			if ok != (tt.want != nil) {
+				t.Fatalf("FixMeasures() fixed = %v, want %v", ok, tt.want != nil)
+			}
+			if !ok {
+				return
+			}
+
+			if got.Timestamp != req.Timestamp || got.LocationID != req.LocationID {
+				t.Errorf("FixMeasures() changed the request: %+v", got)
+			}
+			if len(got.Payload) != 1 || !reflect.DeepEqual(got.Payload[0].MetricData, tt.want) {
+				t.Errorf("FixMeasures() = %+v, want %+v", got.Payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixMeasuresDefaultSpec(t *testing.T) {
+	cat, _ := DefaultSpec().Category("network")
+	req := MetricsReq{
+		Payload: []MetricPayload{{ApplicationID: 1, MetricData: []MetricData{{Key: "packetCount", Value: 12.3456}}}},
+	}
+	rejected := []MeasureError{{MetricError: MetricError{ApplicationID: 1, ErrKey: "packetCount", ErrCode: 703, ErrDesc: "Invalid decimal precision"}}}
+
+	if got, ok := FixMeasures(cat, req, rejected); ok {
+		t.Errorf("FixMeasures() resubmits a simple measure without a precision: %+v", got.Payload)
+	}
+}
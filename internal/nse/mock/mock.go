@@ -0,0 +1,545 @@
+// Package mock implements a mock of the NSE LAMA API for local and UAT
+// testing. It validates requests against the structures in the nse package,
+// enforces sequence IDs and token expiry like the real gateway, and can be
+// told to return specific response codes on demand.
+package mock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// RespCodeInvalidRequest is returned for requests that fail validation,
+	// and as the errCode of invalid measures in a 602 response.
+	RespCodeInvalidRequest = 703
+
+	// Login is the target for injecting responses to login requests.
+	Login = "login"
+)
+
+// validAppIDs are the application IDs accepted in a payload.
+var validAppIDs = map[int]bool{-1: true, 1: true, 2: true, 3: true, 4: true}
+
+// Opts are the options for the mock server.
+type Opts struct {
+	MemberID   string
+	LoginID    string
+	Password   string
+	ExchangeID int
+
+	// TokenTTL is the validity of session tokens. Defaults to nse.TokenTTL.
+	TokenTTL time.Duration
+
+	// Spec is the spec whose categories and measures are accepted. Defaults
+	// to nse.DefaultSpec().
+	Spec *nse.Spec
+
+	// VersionNo is the API version reported in responses. Defaults to the
+	// version of Spec.
+	VersionNo string
+}
+
+// Server is a mock NSE LAMA API server.
+type Server struct {
+	sync.Mutex
+
+	lo   *slog.Logger
+	opts Opts
+	mux  *http.ServeMux
+
+	// tokens maps session tokens to their expiry.
+	tokens map[string]time.Time
+
+	// seqs is the next expected sequence ID of every endpoint.
+	seqs map[string]int
+
+	// faults are the queued response codes to inject per target (an
+	// endpoint or Login).
+	faults map[string][]int
+
+	// accepted is the number of accepted requests per endpoint.
+	accepted map[string]int
+}
+
+// Stats is a snapshot of the state of the mock server.
+type Stats struct {
+	Seqs     map[string]int   `json:"seqs"`
+	Accepted map[string]int   `json:"accepted"`
+	Faults   map[string][]int `json:"faults"`
+	Tokens   int              `json:"tokens"`
+}
+
+// New returns a mock server. Sequence IDs of all the endpoints start at 1.
+func New(opts Opts, lo *slog.Logger) *Server {
+	if opts.TokenTTL <= 0 {
+		opts.TokenTTL = nse.TokenTTL
+	}
+	if opts.Spec == nil {
+		opts.Spec = nse.DefaultSpec()
+	}
+	if opts.VersionNo == "" {
+		opts.VersionNo = opts.Spec.Version
+	}
+
+	s := &Server{
+		lo:       lo,
+		opts:     opts,
+		mux:      http.NewServeMux(),
+		tokens:   make(map[string]time.Time),
+		seqs:     make(map[string]int),
+		faults:   make(map[string][]int),
+		accepted: make(map[string]int),
+	}
+	for _, c := range opts.Spec.Categories {
+		s.seqs[c.Name] = 1
+	}
+
+	s.mux.HandleFunc("/api/V1/auth/login", s.handleLogin)
+	for _, c := range opts.Spec.Categories {
+		c := c
+		s.mux.HandleFunc(c.Path, func(w http.ResponseWriter, r *http.Request) {
+			s.handleMetrics(w, r, c.Name)
+		})
+	}
+
+	// Control endpoints for injecting faults when running as a standalone
+	// server.
+	s.mux.HandleFunc("/mock/inject", s.handleInject)
+	s.mux.HandleFunc("/mock/stats", s.handleStats)
+
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Inject queues a response code to be returned to the next count requests to
+// target, which is an endpoint or Login. Supported codes are 602, 704, 801 and
+// 802 for endpoints, and 701 for Login.
+func (s *Server) Inject(target string, code, count int) error {
+	if err := s.validateFault(target, code); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i := 0; i < count; i++ {
+		s.faults[target] = append(s.faults[target], code)
+	}
+
+	return nil
+}
+
+// SetSeq sets the next expected sequence ID of an endpoint.
+func (s *Server) SetSeq(endpoint string, seq int) {
+	s.Lock()
+	s.seqs[endpoint] = seq
+	s.Unlock()
+}
+
+// ExpireTokens expires all the issued session tokens.
+func (s *Server) ExpireTokens() {
+	s.Lock()
+	for t := range s.tokens {
+		s.tokens[t] = time.Now()
+	}
+	s.Unlock()
+}
+
+// Stats returns a snapshot of the state of the server.
+func (s *Server) Stats() Stats {
+	s.Lock()
+	defer s.Unlock()
+
+	st := Stats{
+		Seqs:     make(map[string]int, len(s.seqs)),
+		Accepted: make(map[string]int, len(s.accepted)),
+		Faults:   make(map[string][]int, len(s.faults)),
+		Tokens:   len(s.tokens),
+	}
+	for k, v := range s.seqs {
+		st.Seqs[k] = v
+	}
+	for k, v := range s.accepted {
+		st.Accepted[k] = v
+	}
+	for k, v := range s.faults {
+		st.Faults[k] = append([]int(nil), v...)
+	}
+
+	return st
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req nse.LoginReq
+	if err := decode(r, &req); err != nil {
+		s.reject(w, http.StatusBadRequest, RespCodeInvalidRequest, fmt.Sprintf("invalid login request: %v", err))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if code, ok := s.nextFault(Login); ok {
+		s.lo.Info("injecting login response", "code", code)
+		writeJSON(w, http.StatusOK, nse.LoginResp{
+			Timestamp:    time.Now().Unix(),
+			VersionNo:    s.opts.VersionNo,
+			MemberID:     req.MemberID,
+			LoginID:      req.LoginID,
+			ResponseCode: code,
+			ResponseDesc: "Invalid login credentials",
+		})
+		return
+	}
+
+	if req.MemberID != s.opts.MemberID || req.LoginID != s.opts.LoginID || req.Password != s.opts.Password {
+		s.lo.Warn("rejecting login with invalid credentials", "member_id", req.MemberID, "login_id", req.LoginID)
+		writeJSON(w, http.StatusOK, nse.LoginResp{
+			Timestamp:    time.Now().Unix(),
+			VersionNo:    s.opts.VersionNo,
+			MemberID:     req.MemberID,
+			LoginID:      req.LoginID,
+			ResponseCode: nse.NSE_RESP_CODE_INVALID_LOGIN,
+			ResponseDesc: "Invalid login credentials",
+		})
+		return
+	}
+
+	token := newToken()
+	s.tokens[token] = time.Now().Add(s.opts.TokenTTL)
+	s.lo.Info("issued session token", "member_id", req.MemberID, "login_id", req.LoginID, "ttl", s.opts.TokenTTL)
+
+	writeJSON(w, http.StatusOK, nse.LoginResp{
+		Timestamp:    time.Now().Unix(),
+		VersionNo:    s.opts.VersionNo,
+		MemberID:     req.MemberID,
+		LoginID:      req.LoginID,
+		ResponseCode: nse.NSE_RESP_CODE_SUCCESS,
+		ResponseDesc: "Login successful",
+		Token:        token,
+	})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Authenticate.
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	expiry, ok := s.tokens[token]
+	if !ok {
+		s.reject(w, http.StatusUnauthorized, nse.NSE_RESP_CODE_INVALID_TOKEN, "Invalid token")
+		return
+	}
+	if !time.Now().Before(expiry) {
+		delete(s.tokens, token)
+		s.reject(w, http.StatusUnauthorized, nse.NSE_RESP_CODE_EXPIRED_TOKEN, "Token expired")
+		return
+	}
+
+	var req nse.MetricsReq
+	if err := decode(r, &req); err != nil {
+		s.reject(w, http.StatusBadRequest, RespCodeInvalidRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	fault, hasFault := s.nextFault(endpoint)
+	if hasFault {
+		s.lo.Info("injecting response", "endpoint", endpoint, "code", fault)
+	}
+
+	switch {
+	case hasFault && fault == nse.NSE_RESP_CODE_INVALID_TOKEN:
+		delete(s.tokens, token)
+		s.reject(w, http.StatusUnauthorized, fault, "Invalid token")
+		return
+	case hasFault && fault == nse.NSE_RESP_CODE_EXPIRED_TOKEN:
+		delete(s.tokens, token)
+		s.reject(w, http.StatusUnauthorized, fault, "Token expired")
+		return
+	}
+
+	if err := s.validate(req); err != nil {
+		s.reject(w, http.StatusBadRequest, RespCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Sequence IDs must be strictly consecutive.
+	expected := s.seqs[endpoint]
+	if req.SequenceID != expected || (hasFault && fault == nse.NSE_RESP_CODE_INVALID_SEQ_ID) {
+		s.reject(w, http.StatusBadRequest, nse.NSE_RESP_CODE_INVALID_SEQ_ID, fmt.Sprintf("Invalid SequenceId. SequenceId should be %d", expected))
+		return
+	}
+
+	errs := s.validateMeasures(endpoint, req)
+	if len(errs) == 0 && hasFault && fault == nse.NSE_RESP_CODE_PARTIAL_SUCCESS {
+		// Report the first measure as invalid.
+		if d := firstMeasure(req); d != nil {
+			errs = append(errs, measureError(req.Payload[0].ApplicationID, *d, "Injected measure error"))
+		}
+	}
+
+	s.seqs[endpoint]++
+	s.accepted[endpoint]++
+
+	resp := nse.MetricsResp{
+		Timestamp:    time.Now().Unix(),
+		VersionNo:    s.opts.VersionNo,
+		ResponseCode: nse.NSE_RESP_CODE_SUCCESS,
+		ResponseDesc: "Data received successfully",
+	}
+	if len(errs) > 0 {
+		resp.ResponseCode = nse.NSE_RESP_CODE_PARTIAL_SUCCESS
+		resp.ResponseDesc = "Data received partially"
+		resp.Errors = errs
+	}
+
+	s.lo.Info("accepted metrics", "endpoint", endpoint, "location_id", req.LocationID, "sequence_id", req.SequenceID, "response_code", resp.ResponseCode)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInject queues injected responses.
+//
+//	POST /mock/inject?target=hardware&code=704&count=1
+func (s *Server) handleInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		target = r.FormValue("target")
+		code   int
+		count  = 1
+	)
+	if _, err := fmt.Sscan(r.FormValue("code"), &code); err != nil {
+		http.Error(w, "invalid code", http.StatusBadRequest)
+		return
+	}
+	if c := r.FormValue("count"); c != "" {
+		if _, err := fmt.Sscan(c, &count); err != nil || count < 1 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.Inject(target, code, count); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lo.Info("queued injected responses", "target", target, "code", code, "count", count)
+	writeJSON(w, http.StatusOK, s.Stats())
+}
+
+// handleStats returns the state of the server.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Stats())
+}
+
+// validate checks the request fields that are common to all the endpoints.
+func (s *Server) validate(req nse.MetricsReq) error {
+	switch {
+	case req.MemberID != s.opts.MemberID:
+		return fmt.Errorf("invalid memberId: %q", req.MemberID)
+	case req.ExchangeID != s.opts.ExchangeID:
+		return fmt.Errorf("invalid exchangeId: %d", req.ExchangeID)
+	case req.LocationID <= 0:
+		return fmt.Errorf("invalid locationId: %d", req.LocationID)
+	case req.Timestamp <= 0:
+		return fmt.Errorf("invalid timestamp: %d", req.Timestamp)
+	case len(req.Payload) == 0:
+		return fmt.Errorf("empty payload")
+	}
+
+	for _, p := range req.Payload {
+		if !validAppIDs[p.ApplicationID] {
+			return fmt.Errorf("invalid applicationId: %d", p.ApplicationID)
+		}
+		if len(p.MetricData) == 0 {
+			return fmt.Errorf("empty metricData for applicationId %d", p.ApplicationID)
+		}
+	}
+
+	return nil
+}
+
+// nextFault pops the next injected response code of a target, if any.
+func (s *Server) nextFault(target string) (int, bool) {
+	q := s.faults[target]
+	if len(q) == 0 {
+		return 0, false
+	}
+
+	code := q[0]
+	if len(q) == 1 {
+		delete(s.faults, target)
+	} else {
+		s.faults[target] = q[1:]
+	}
+
+	return code, true
+}
+
+func (s *Server) reject(w http.ResponseWriter, status, code int, desc string) {
+	s.lo.Warn("rejecting request", "response_code", code, "response_desc", desc)
+	writeJSON(w, status, nse.MetricsResp{
+		Timestamp:    time.Now().Unix(),
+		VersionNo:    s.opts.VersionNo,
+		ResponseCode: code,
+		ResponseDesc: desc,
+	})
+}
+
+// validateMeasures checks every measure of a request against the keys and
+// value types of the endpoint's category.
+func (s *Server) validateMeasures(endpoint string, req nse.MetricsReq) []nse.MetricError {
+	var (
+		cat, _ = s.opts.Spec.Category(endpoint)
+		errs   []nse.MetricError
+	)
+
+	for _, p := range req.Payload {
+		seen := make(map[string]bool)
+		for _, d := range p.MetricData {
+			m, ok := cat.Measure(d.Key)
+			switch {
+			case !ok:
+				errs = append(errs, measureError(p.ApplicationID, d, "Unknown key"))
+				continue
+			case seen[d.Key]:
+				errs = append(errs, measureError(p.ApplicationID, d, "Duplicate key"))
+				continue
+			}
+			seen[d.Key] = true
+
+			if err := validateValue(m.Kind, d.Value); err != nil {
+				errs = append(errs, measureError(p.ApplicationID, d, err.Error()))
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateValue checks that a value is a number for simple measures, and a
+// min, max, avg, med object for summary ones.
+func validateValue(kind nse.ValueKind, v interface{}) error {
+	if kind == nse.Simple {
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("value must be a number")
+		}
+		return nil
+	}
+
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("value must be an object with min, max, avg and med")
+	}
+
+	b, _ := json.Marshal(obj)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var mv nse.MetricValue
+	if err := dec.Decode(&mv); err != nil {
+		return fmt.Errorf("invalid value: %v", err)
+	}
+	for _, f := range []string{"min", "max", "avg", "med"} {
+		if _, ok := obj[f]; !ok {
+			return fmt.Errorf("value is missing %s", f)
+		}
+	}
+	if mv.Min > mv.Max {
+		return fmt.Errorf("min is greater than max")
+	}
+
+	return nil
+}
+
+func measureError(appID int, d nse.MetricData, desc string) nse.MetricError {
+	return nse.MetricError{
+		ApplicationID: appID,
+		ErrCode:       RespCodeInvalidRequest,
+		ErrDesc:       desc,
+		ErrKey:        d.Key,
+		Measure:       d.Value,
+	}
+}
+
+func firstMeasure(req nse.MetricsReq) *nse.MetricData {
+	if len(req.Payload) == 0 || len(req.Payload[0].MetricData) == 0 {
+		return nil
+	}
+
+	return &req.Payload[0].MetricData[0]
+}
+
+func (s *Server) validateFault(target string, code int) error {
+	if target == Login {
+		if code != nse.NSE_RESP_CODE_INVALID_LOGIN {
+			return fmt.Errorf("unsupported login response code: %d", code)
+		}
+		return nil
+	}
+
+	if _, ok := s.opts.Spec.Category(target); !ok {
+		return fmt.Errorf("unknown target: %q", target)
+	}
+
+	switch code {
+	case nse.NSE_RESP_CODE_PARTIAL_SUCCESS,
+		nse.NSE_RESP_CODE_INVALID_SEQ_ID,
+		nse.NSE_RESP_CODE_INVALID_TOKEN,
+		nse.NSE_RESP_CODE_EXPIRED_TOKEN:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported %s response code: %d", target, code)
+}
+
+// decode strictly decodes a JSON request body into v.
+func decode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
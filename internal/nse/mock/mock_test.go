@@ -0,0 +1,269 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+	"github.com/zerodha/mii-lama/pkg/models"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	testOpts = Opts{
+		MemberID:   "member",
+		LoginID:    "login",
+		Password:   "password",
+		ExchangeID: 1,
+	}
+
+	testCreds = nse.LoginReq{
+		MemberID: testOpts.MemberID,
+		LoginID:  testOpts.LoginID,
+		Password: testOpts.Password,
+	}
+)
+
+// post sends a JSON request to the server and decodes the response into out.
+func post(t *testing.T, s *Server, path, token string, body, out interface{}) int {
+	t.Helper()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+		t.Fatalf("failed to decode response to %s: %v", path, err)
+	}
+
+	return w.Code
+}
+
+// login logs in and returns the response.
+func login(t *testing.T, s *Server, creds nse.LoginReq) nse.LoginResp {
+	t.Helper()
+
+	var r nse.LoginResp
+	post(t, s, "/api/V1/auth/login", "", creds, &r)
+
+	return r
+}
+
+// token logs in with valid credentials and returns the session token.
+func token(t *testing.T, s *Server) string {
+	t.Helper()
+
+	r := login(t, s, testCreds)
+	if r.ResponseCode != nse.NSE_RESP_CODE_SUCCESS {
+		t.Fatalf("login response code = %d, want %d", r.ResponseCode, nse.NSE_RESP_CODE_SUCCESS)
+	}
+
+	return r.Token
+}
+
+// push sends a valid hardware request with the sequence ID seq.
+func push(t *testing.T, s *Server, token string, seq int) (int, nse.MetricsResp) {
+	t.Helper()
+
+	mgr, err := nse.New(testLogger, nse.Opts{
+		MemberID:   testOpts.MemberID,
+		LoginID:    testOpts.LoginID,
+		ExchangeID: testOpts.ExchangeID,
+	})
+	if err != nil {
+		t.Fatalf("nse.New() error = %v", err)
+	}
+
+	cat, _ := mgr.Spec().Category("hardware")
+	samples := make(models.Samples, len(cat.Measures))
+	for _, m := range cat.Measures {
+		samples[m.Query] = []float64{10, 20, 30}
+	}
+	req := mgr.NewRequest(cat, 1, samples)
+	req.SequenceID = seq
+
+	var r nse.MetricsResp
+	status := post(t, s, cat.Path, token, req, &r)
+
+	return status, r
+}
+
+func TestSequence(t *testing.T) {
+	s := New(testOpts, testLogger)
+	tok := token(t, s)
+
+	tests := []struct {
+		name string
+
+		// set, if not 0, is the sequence ID the server is told to expect.
+		set    int
+		seq    int
+		status int
+		code   int
+		desc   string
+	}{
+		{name: "first", seq: 1, status: http.StatusOK, code: nse.NSE_RESP_CODE_SUCCESS},
+		{name: "repeated", seq: 1, status: http.StatusBadRequest, code: nse.NSE_RESP_CODE_INVALID_SEQ_ID, desc: "SequenceId should be 2"},
+		{name: "skipped", seq: 3, status: http.StatusBadRequest, code: nse.NSE_RESP_CODE_INVALID_SEQ_ID, desc: "SequenceId should be 2"},
+		{name: "next", seq: 2, status: http.StatusOK, code: nse.NSE_RESP_CODE_SUCCESS},
+		{name: "set", set: 10, seq: 3, status: http.StatusBadRequest, code: nse.NSE_RESP_CODE_INVALID_SEQ_ID, desc: "SequenceId should be 10"},
+		{name: "after set", seq: 10, status: http.StatusOK, code: nse.NSE_RESP_CODE_SUCCESS},
+	}
+
+	for _, tt := range tests {
+		if tt.set != 0 {
+			s.SetSeq("hardware", tt.set)
+		}
+
+		status, r := push(t, s, tok, tt.seq)
+		if status != tt.status || r.ResponseCode != tt.code {
+			t.Fatalf("%s: push(%d) = HTTP %d, code %d, want HTTP %d, code %d", tt.name, tt.seq, status, r.ResponseCode, tt.status, tt.code)
+		}
+		if !strings.Contains(r.ResponseDesc, tt.desc) {
+			t.Fatalf("%s: push(%d) description = %q, want %q", tt.name, tt.seq, r.ResponseDesc, tt.desc)
+		}
+	}
+
+	if n := s.Stats().Accepted["hardware"]; n != 3 {
+		t.Errorf("%d requests accepted, want 3", n)
+	}
+}
+
+func TestToken(t *testing.T) {
+	opts := testOpts
+	opts.TokenTTL = 20 * time.Millisecond
+	s := New(opts, testLogger)
+
+	if status, r := push(t, s, "", 1); status != http.StatusUnauthorized || r.ResponseCode != nse.NSE_RESP_CODE_INVALID_TOKEN {
+		t.Errorf("push() without a token = HTTP %d, code %d, want HTTP 401, code %d", status, r.ResponseCode, nse.NSE_RESP_CODE_INVALID_TOKEN)
+	}
+
+	bad := testCreds
+	bad.Password = "wrong"
+	if r := login(t, s, bad); r.ResponseCode != nse.NSE_RESP_CODE_INVALID_LOGIN || r.Token != "" {
+		t.Errorf("login with a wrong password = code %d, token %q, want code %d, no token", r.ResponseCode, r.Token, nse.NSE_RESP_CODE_INVALID_LOGIN)
+	}
+
+	// Tokens expire after TokenTTL, and an expired token is then unknown.
+	tok := token(t, s)
+	if status, r := push(t, s, tok, 1); status != http.StatusOK {
+		t.Fatalf("push() = HTTP %d, code %d, want HTTP 200", status, r.ResponseCode)
+	}
+	time.Sleep(opts.TokenTTL)
+	if status, r := push(t, s, tok, 2); status != http.StatusUnauthorized || r.ResponseCode != nse.NSE_RESP_CODE_EXPIRED_TOKEN {
+		t.Errorf("push() with an expired token = HTTP %d, code %d, want HTTP 401, code %d", status, r.ResponseCode, nse.NSE_RESP_CODE_EXPIRED_TOKEN)
+	}
+	if _, r := push(t, s, tok, 2); r.ResponseCode != nse.NSE_RESP_CODE_INVALID_TOKEN {
+		t.Errorf("push() with a removed token = code %d, want %d", r.ResponseCode, nse.NSE_RESP_CODE_INVALID_TOKEN)
+	}
+
+	// ExpireTokens expires the issued tokens right away.
+	s = New(testOpts, testLogger)
+	tok = token(t, s)
+	s.ExpireTokens()
+	if _, r := push(t, s, tok, 1); r.ResponseCode != nse.NSE_RESP_CODE_EXPIRED_TOKEN {
+		t.Errorf("push() after ExpireTokens() = code %d, want %d", r.ResponseCode, nse.NSE_RESP_CODE_EXPIRED_TOKEN)
+	}
+}
+
+func TestInject(t *testing.T) {
+	tests := []struct {
+		code   int
+		status int
+
+		// seq is the next expected sequence ID after the injected response.
+		seq int
+
+		// tokenKept is whether the token is still valid after it.
+		tokenKept bool
+	}{
+		{nse.NSE_RESP_CODE_PARTIAL_SUCCESS, http.StatusOK, 2, true},
+		{nse.NSE_RESP_CODE_INVALID_SEQ_ID, http.StatusBadRequest, 1, true},
+		{nse.NSE_RESP_CODE_INVALID_TOKEN, http.StatusUnauthorized, 1, false},
+		{nse.NSE_RESP_CODE_EXPIRED_TOKEN, http.StatusUnauthorized, 1, false},
+	}
+
+	for _, tt := range tests {
+		s := New(testOpts, testLogger)
+		tok := token(t, s)
+
+		if err := s.Inject("hardware", tt.code, 1); err != nil {
+			t.Fatalf("Inject(%d) error = %v", tt.code, err)
+		}
+
+		status, r := push(t, s, tok, 1)
+		if status != tt.status || r.ResponseCode != tt.code {
+			t.Errorf("push() after Inject(%d) = HTTP %d, code %d, want HTTP %d, code %d", tt.code, status, r.ResponseCode, tt.status, tt.code)
+			continue
+		}
+		if tt.code == nse.NSE_RESP_CODE_PARTIAL_SUCCESS && len(r.Errors) != 1 {
+			t.Errorf("push() after Inject(%d) = %d measure errors, want 1", tt.code, len(r.Errors))
+		}
+		if seq := s.Stats().Seqs["hardware"]; seq != tt.seq {
+			t.Errorf("next sequence ID after Inject(%d) = %d, want %d", tt.code, seq, tt.seq)
+		}
+
+		// The injected response is only returned once.
+		want := nse.NSE_RESP_CODE_SUCCESS
+		if !tt.tokenKept {
+			want = nse.NSE_RESP_CODE_INVALID_TOKEN
+		}
+		if _, r := push(t, s, tok, tt.seq); r.ResponseCode != want {
+			t.Errorf("second push() after Inject(%d) = code %d, want %d", tt.code, r.ResponseCode, want)
+		}
+	}
+}
+
+func TestInjectLogin(t *testing.T) {
+	s := New(testOpts, testLogger)
+	if err := s.Inject(Login, nse.NSE_RESP_CODE_INVALID_LOGIN, 2); err != nil {
+		t.Fatalf("Inject() error = %v", err)
+	}
+
+	// Valid credentials are rejected count times.
+	for i := 0; i < 2; i++ {
+		if r := login(t, s, testCreds); r.ResponseCode != nse.NSE_RESP_CODE_INVALID_LOGIN || r.Token != "" {
+			t.Fatalf("login %d = code %d, token %q, want code %d, no token", i+1, r.ResponseCode, r.Token, nse.NSE_RESP_CODE_INVALID_LOGIN)
+		}
+	}
+	token(t, s)
+}
+
+func TestInjectUnsupported(t *testing.T) {
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"hardware", nse.NSE_RESP_CODE_SUCCESS},
+		{"hardware", nse.NSE_RESP_CODE_INVALID_LOGIN},
+		{Login, nse.NSE_RESP_CODE_EXPIRED_TOKEN},
+		{"unknown", nse.NSE_RESP_CODE_PARTIAL_SUCCESS},
+	}
+
+	s := New(testOpts, testLogger)
+	for _, tt := range tests {
+		if err := s.Inject(tt.target, tt.code, 1); err == nil {
+			t.Errorf("Inject(%s, %d) error = nil, want an error", tt.target, tt.code)
+		}
+	}
+
+	if f := s.Stats().Faults; len(f) != 0 {
+		t.Errorf("faults = %v, want none", f)
+	}
+}
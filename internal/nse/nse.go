@@ -2,18 +2,22 @@ package nse
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/zerodha/mii-lama/pkg/models"
+	"github.com/zerodha/mii-lama/internal/retry"
+	"github.com/zerodha/mii-lama/internal/state"
 	"golang.org/x/exp/slog"
 )
 
@@ -27,6 +31,13 @@ const (
 	NSE_RESP_CODE_EXPIRED_TOKEN   = 802
 )
 
+// TokenTTL is the validity of a LAMA session token.
+const TokenTTL = 24 * time.Hour
+
+// tokenRefreshRetry is the delay before a failed proactive token refresh is
+// attempted again.
+const tokenRefreshRetry = time.Minute
+
 type Opts struct {
 	URL             string
 	LoginID         string
@@ -35,6 +46,37 @@ type Opts struct {
 	Password        string
 	Timeout         time.Duration
 	IdleConnTimeout time.Duration
+
+	// BreakerThreshold is the number of consecutive transport failures after
+	// which pushes to an endpoint are paused for BreakerCooldown. 0 disables
+	// the circuit breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// MaxLoginAttempts is the number of consecutive logins that LAMA may
+	// reject before logins are paused. An invalid login (701) pauses them
+	// right away. 0 disables the limit, except for 701.
+	MaxLoginAttempts int
+
+	// TokenRefreshBefore is how long before the session token expires it's
+	// refreshed in the background by RunTokenRefresh.
+	TokenRefreshBefore time.Duration
+
+	// OnLoginLocked, if set, is called when logins are paused, with the
+	// error of the last rejected login.
+	OnLoginLocked func(err error)
+
+	// Spec is the LAMA metrics spec the requests are built and pushed by.
+	// Defaults to DefaultSpec().
+	Spec *Spec
+
+	// Store persists acknowledged sequence IDs across restarts. If it's nil,
+	// sequence IDs start from 1 on every boot.
+	Store state.Store
+
+	// DryRun, if set, makes the manager write the payloads to it instead of
+	// submitting them to LAMA.
+	DryRun io.Writer
 }
 
 // Manager provides access to the NSE LAMA API.
@@ -47,11 +89,31 @@ type Manager struct {
 	client  *http.Client
 	headers http.Header
 
-	token string
+	token         string
+	tokenIssuedAt time.Time
 
-	dbSeqID  int
-	hwSeqID  int
-	netSeqID int
+	// loginCall is the login in flight, if any. Concurrent logins wait for
+	// it instead of logging in again.
+	loginMu   sync.Mutex
+	loginCall *loginCall
+
+	// loginFailures is the number of consecutive logins rejected by LAMA.
+	// loginLock is the error of the login that paused logins, if any.
+	loginFailures int
+	loginLock     error
+
+	// lamaVersion is the last API version reported by LAMA that differs
+	// from the spec's, if any.
+	lamaVersion string
+
+	seqs     *SeqTracker
+	breakers map[string]*retry.Breaker
+}
+
+// loginCall is a login in flight.
+type loginCall struct {
+	done chan struct{}
+	err  error
 }
 
 type LoginReq struct {
@@ -71,17 +133,20 @@ type LoginResp struct {
 }
 
 type MetricsResp struct {
-	Timestamp    int64  `json:"timestamp"`
-	VersionNo    string `json:"versionNo"`
-	ResponseCode int    `json:"responseCode"`
-	ResponseDesc string `json:"responseDesc"`
-	Errors       []struct {
-		ApplicationID int         `json:"applicationId"`
-		ErrCode       int         `json:"errCode"`
-		ErrDesc       string      `json:"errDesc"`
-		ErrKey        string      `json:"errKey"`
-		Measure       interface{} `json:"measure"`
-	} `json:"errors"`
+	Timestamp    int64         `json:"timestamp"`
+	VersionNo    string        `json:"versionNo"`
+	ResponseCode int           `json:"responseCode"`
+	ResponseDesc string        `json:"responseDesc"`
+	Errors       []MetricError `json:"errors"`
+}
+
+// MetricError is an error reported by LAMA for a single measure.
+type MetricError struct {
+	ApplicationID int         `json:"applicationId"`
+	ErrCode       int         `json:"errCode"`
+	ErrDesc       string      `json:"errDesc"`
+	ErrKey        string      `json:"errKey"`
+	Measure       interface{} `json:"measure"`
 }
 
 type MetricData struct {
@@ -107,34 +172,8 @@ type MetricPayload struct {
 	MetricData    []MetricData `json:"metricData"`
 }
 
-type HardwareReq struct {
-	MemberID   string          `json:"memberId"`
-	ExchangeID int             `json:"exchangeId"`
-	SequenceID int             `json:"sequenceId"`
-	LocationID int             `json:"locationId"`
-	Timestamp  int64           `json:"timestamp"`
-	Payload    []MetricPayload `json:"payload"`
-}
-
-type DatabaseReq struct {
-	MemberID   string          `json:"memberId"`
-	ExchangeID int             `json:"exchangeId"`
-	SequenceID int             `json:"sequenceId"`
-	LocationID int             `json:"locationId"`
-	Timestamp  int64           `json:"timestamp"`
-	Payload    []MetricPayload `json:"payload"`
-}
-
-type NetworkReq struct {
-	MemberID   string          `json:"memberId"`
-	ExchangeID int             `json:"exchangeId"`
-	SequenceID int             `json:"sequenceId"`
-	LocationID int             `json:"locationId"`
-	Timestamp  int64           `json:"timestamp"`
-	Payload    []MetricPayload `json:"payload"`
-}
-
-type AppReq struct {
+// MetricsReq is the request body of all the LAMA metrics endpoints.
+type MetricsReq struct {
 	MemberID   string          `json:"memberId"`
 	ExchangeID int             `json:"exchangeId"`
 	SequenceID int             `json:"sequenceId"`
@@ -169,30 +208,192 @@ func New(lo *slog.Logger, opts Opts) (*Manager, error) {
 	lgr := lo.With("login_id", opts.LoginID, "member_id", opts.MemberID, "exchange_id", opts.ExchangeID)
 	lgr.Debug("mii-lama client created")
 
+	if opts.Spec == nil {
+		opts.Spec = DefaultSpec()
+	}
+
+	// Resume the sequence IDs from the last acknowledged ones, if any.
+	seqs, err := NewSeqTracker(opts.Store, lgr, opts.Spec.Names()...)
+	if err != nil {
+		return nil, err
+	}
+
 	mgr := &Manager{
 		opts:     opts,
 		lo:       lgr,
 		client:   client,
 		headers:  h,
-		hwSeqID:  1,
-		dbSeqID:  1,
-		netSeqID: 1,
+		seqs:     seqs,
+		breakers: make(map[string]*retry.Breaker),
 	}
 
+	lgr.Info("initialised sequence IDs", "seq_ids", seqs.Stats())
+
 	return mgr, nil
 }
 
+// TokenIssuedAt returns the time at which the current session token was
+// obtained. It's zero if there has been no successful login.
+func (mgr *Manager) TokenIssuedAt() time.Time {
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	return mgr.tokenIssuedAt
+}
+
+// SeqStats returns the sequence ID counters of all LAMA endpoints.
+func (mgr *Manager) SeqStats() map[string]SeqStats {
+	return mgr.seqs.Stats()
+}
+
 // Login is used to generate a session token for further requests.
-// Token is valid for 24 hours and after that it should be renewed again.
-func (mgr *Manager) Login() error {
-	endpoint := fmt.Sprintf("%s%s", mgr.opts.URL, "/api/V1/auth/login")
-	mgr.lo.Info("Starting login process", "URL", endpoint)
+// Token is valid for TokenTTL and is refreshed by RunTokenRefresh before it
+// expires. Concurrent calls share a single login. If logins are paused,
+// ErrLoginLocked is returned without a login attempt.
+func (mgr *Manager) Login(ctx context.Context) error {
+	mgr.loginMu.Lock()
+	c := mgr.loginCall
+	if c == nil {
+		c = &loginCall{done: make(chan struct{})}
+		mgr.loginCall = c
+
+		// The login is shared, so it isn't cut short if the caller that
+		// started it gives up. The HTTP client's timeout still applies.
+		go func() {
+			c.err = mgr.loginOnce(context.WithoutCancel(ctx))
+
+			mgr.loginMu.Lock()
+			mgr.loginCall = nil
+			mgr.loginMu.Unlock()
+
+			close(c.done)
+		}()
+	}
+	mgr.loginMu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	loginPayload := LoginReq{
+// loginOnce logs in with the current credentials, unless logins are paused.
+func (mgr *Manager) loginOnce(ctx context.Context) error {
+	mgr.RLock()
+	creds := LoginReq{
 		MemberID: mgr.opts.MemberID,
 		LoginID:  mgr.opts.LoginID,
 		Password: mgr.opts.Password,
 	}
+	lock := mgr.loginLock
+	mgr.RUnlock()
+
+	if lock != nil {
+		return fmt.Errorf("%w: %v", ErrLoginLocked, lock)
+	}
+
+	return mgr.login(ctx, creds)
+}
+
+// refreshToken logs in again after LAMA rejected the session token stale.
+// If another push already replaced it in the meantime, there's no login.
+func (mgr *Manager) refreshToken(ctx context.Context, stale string) error {
+	mgr.RLock()
+	current := mgr.token
+	mgr.RUnlock()
+
+	if current != stale {
+		return nil
+	}
+
+	return mgr.Login(ctx)
+}
+
+// RunTokenRefresh logs in again TokenRefreshBefore the session token
+// expires, so that pushes don't fail with an expired token, until ctx is
+// cancelled. Failed refreshes are retried every tokenRefreshRetry.
+func (mgr *Manager) RunTokenRefresh(ctx context.Context) {
+	for {
+		// Check back regularly while there's no token yet, or if it was
+		// replaced by a login elsewhere.
+		wait := tokenRefreshRetry
+		if issuedAt := mgr.TokenIssuedAt(); !issuedAt.IsZero() {
+			due := time.Until(issuedAt.Add(TokenTTL - mgr.opts.TokenRefreshBefore))
+			if due <= 0 {
+				mgr.lo.Info("Refreshing session token before it expires", "issued_at", issuedAt)
+				if err := mgr.Login(ctx); err != nil && ctx.Err() == nil && !errors.Is(err, ErrLoginLocked) {
+					mgr.lo.Error("Failed to refresh session token", "retry_in", tokenRefreshRetry, "error", err)
+				}
+			} else if due < wait {
+				wait = due
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LoginLocked reports whether logins are paused after LAMA rejected the
+// credentials.
+func (mgr *Manager) LoginLocked() bool {
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	return mgr.loginLock != nil
+}
+
+// ResetLoginLock resumes logins paused after LAMA rejected the credentials,
+// eg: once they've been fixed on LAMA's side.
+func (mgr *Manager) ResetLoginLock() {
+	mgr.Lock()
+	mgr.loginFailures = 0
+	mgr.loginLock = nil
+	mgr.Unlock()
+}
+
+// UpdateCredentials replaces the credentials used to log in, if they differ
+// from the current ones. Outside of dry run mode, it logs in with the new
+// credentials first, even if logins are paused, and keeps the current ones
+// if that fails. Sequence IDs are left as they are.
+func (mgr *Manager) UpdateCredentials(ctx context.Context, memberID, loginID, password string) error {
+	creds := LoginReq{
+		MemberID: memberID,
+		LoginID:  loginID,
+		Password: password,
+	}
+
+	mgr.RLock()
+	changed := creds != LoginReq{MemberID: mgr.opts.MemberID, LoginID: mgr.opts.LoginID, Password: mgr.opts.Password}
+	mgr.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	if mgr.opts.DryRun == nil {
+		if err := mgr.login(ctx, creds); err != nil {
+			return err
+		}
+	}
+
+	mgr.Lock()
+	mgr.opts.MemberID, mgr.opts.LoginID, mgr.opts.Password = memberID, loginID, password
+	mgr.Unlock()
+
+	mgr.lo.Info("updated credentials", "new_login_id", loginID, "new_member_id", memberID)
+
+	return nil
+}
+
+// login logs in with the given credentials and keeps the session token.
+func (mgr *Manager) login(ctx context.Context, loginPayload LoginReq) error {
+	endpoint := fmt.Sprintf("%s%s", mgr.opts.URL, "/api/V1/auth/login")
+	mgr.lo.Info("Starting login process", "URL", endpoint)
 
 	payload, err := json.Marshal(loginPayload)
 	if err != nil {
@@ -202,7 +403,7 @@ func (mgr *Manager) Login() error {
 
 	mgr.lo.Debug("Prepared login request payload", "payload", string(payload))
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(payload))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(payload))
 	if err != nil {
 		mgr.lo.Error("Unable to create HTTP request", "error", err)
 		return fmt.Errorf("failed to create HTTP request: %v", err)
@@ -216,7 +417,7 @@ func (mgr *Manager) Login() error {
 	resp, err := mgr.client.Do(req)
 	if err != nil {
 		mgr.lo.Error("HTTP request failed", "error", err)
-		return fmt.Errorf("failed to send HTTP request: %v", err)
+		return fmt.Errorf("%w: failed to send HTTP request: %v", ErrTransport, err)
 	}
 	defer resp.Body.Close()
 
@@ -224,447 +425,306 @@ func (mgr *Manager) Login() error {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
 		mgr.lo.Error("Unexpected HTTP status code", "status_code", resp.StatusCode, "response_body", bodyString)
-		return fmt.Errorf("HTTP request returned status code %d", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%w: HTTP request returned status code %d", ErrTransport, resp.StatusCode)
+		}
+		return mgr.loginRejected(&ErrRejected{HTTPStatus: resp.StatusCode}, false)
 	}
 
 	var r LoginResp
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
 		mgr.lo.Error("Unable to unmarshal login response", "error", err)
-		return fmt.Errorf("failed to unmarshal login response: %v", err)
+		return fmt.Errorf("%w: %w: failed to unmarshal login response: %v", ErrTransport, ErrMalformedResponse, err)
 	}
+	mgr.checkVersion(r.VersionNo)
 
 	if r.ResponseCode != NSE_RESP_CODE_SUCCESS {
-		mgr.lo.Error("Login failed", "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "login_id", mgr.opts.LoginID, "member_id", mgr.opts.MemberID)
-		return fmt.Errorf("login failed with NSE response code %d and description: %s", r.ResponseCode, r.ResponseDesc)
+		mgr.lo.Error("Login failed", "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "login_id", loginPayload.LoginID, "member_id", loginPayload.MemberID)
+		if r.ResponseCode == NSE_RESP_CODE_INVALID_LOGIN {
+			return mgr.loginRejected(&ErrRejected{HTTPStatus: resp.StatusCode, Code: r.ResponseCode, Desc: r.ResponseDesc}, true)
+		}
+		return mgr.loginRejected(fmt.Errorf("login failed with NSE response code %d and description: %s", r.ResponseCode, r.ResponseDesc), false)
 	}
 
-	mgr.lo.Info("Login successful", "login_id", mgr.opts.LoginID, "member_id", mgr.opts.MemberID, "token", r.Token)
+	mgr.lo.Info("Login successful", "login_id", loginPayload.LoginID, "member_id", loginPayload.MemberID, "token", r.Token)
 
 	mgr.Lock()
 	mgr.token = r.Token
+	mgr.tokenIssuedAt = time.Now()
+	mgr.loginFailures = 0
+	mgr.loginLock = nil
 	mgr.Unlock()
 
 	return nil
 }
 
-// PushHWMetrics is used to push database metrics to NSE LAMA API.
-func (mgr *Manager) PushHWMetrics(locationID int, host string, data models.HWPromResp) error {
-	endpoint := fmt.Sprintf("%s%s", mgr.opts.URL, "/api/V1/metrics/hardware")
-
-	mgr.RLock()
-	token := mgr.token
-	seqID := mgr.hwSeqID
-	mgr.RUnlock()
-
-	hwPayload := createHardwareReq(data, mgr.opts.MemberID, mgr.opts.ExchangeID, seqID, locationID, 1)
-
-	payload, err := json.Marshal(hwPayload)
-	if err != nil {
-		mgr.lo.Error("Failed to marshal hardware metrics payload", "error", err)
-		return fmt.Errorf("failed to marshal hardware metrics payload: %v", err)
-	}
-
-	mgr.lo.Info("Preparing to send hardware metrics", "host", host, "locationID", locationID, "URL", endpoint, "payload", string(payload), "headers", mgr.headers)
-
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(payload))
-	if err != nil {
-		mgr.lo.Error("Failed to create HTTP request", "error", err)
-		return fmt.Errorf("failed to create HTTP request: %v", err)
+// loginRejected counts a login rejected by LAMA and pauses logins if the
+// credentials are invalid or too many logins in a row were rejected. Once
+// paused, ErrLoginLocked is returned along with err.
+func (mgr *Manager) loginRejected(err error, invalid bool) error {
+	mgr.Lock()
+	mgr.loginFailures++
+	failures := mgr.loginFailures
+	lock := invalid || (mgr.opts.MaxLoginAttempts > 0 && failures >= mgr.opts.MaxLoginAttempts)
+	if lock {
+		mgr.loginLock = err
 	}
+	mgr.Unlock()
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	for k, v := range mgr.headers {
-		req.Header.Set(k, strings.Join(v, ","))
+	if !lock {
+		return err
 	}
 
-	resp, err := mgr.client.Do(req)
-	if err != nil {
-		mgr.lo.Error("Hardware metrics HTTP request failed", "error", err)
-		return fmt.Errorf("hardware metrics HTTP request failed: %v", err)
+	mgr.lo.Error("LAMA rejected the credentials, pausing logins and pushes until they're changed or the config is reloaded", "failed_logins", failures, "error", err)
+	if mgr.opts.OnLoginLocked != nil {
+		mgr.opts.OnLoginLocked(err)
 	}
-	defer resp.Body.Close()
 
-	var r MetricsResp
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		mgr.lo.Error("Failed to unmarshal hardware metrics response", "error", err)
-		return fmt.Errorf("failed to unmarshal hardware metrics response: %v", err)
-	}
+	return fmt.Errorf("%w: %w", ErrLoginLocked, err)
+}
 
-	mgr.lo.Info("Received response for hardware metrics push", "response_code", r.ResponseCode, "response_description", r.ResponseDesc, "http_status", resp.StatusCode)
+// Spec returns the LAMA metrics spec of the manager.
+func (mgr *Manager) Spec() *Spec {
+	return mgr.opts.Spec
+}
 
-	if resp.StatusCode != http.StatusOK {
-		mgr.lo.Error("Hardware metrics push failed", "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "errors", r.Errors)
-		switch r.ResponseCode {
-		case NSE_RESP_CODE_INVALID_TOKEN, NSE_RESP_CODE_EXPIRED_TOKEN:
-			mgr.lo.Warn("Token is invalid or expired, attempting to log in again")
-			if err := mgr.Login(); err != nil {
-				mgr.lo.Error("Relogin attempt failed", "error", err)
-				return fmt.Errorf("failed to log in again: %v", err)
-			}
-			return fmt.Errorf("new token obtained after relogin, retrying hardware metrics push")
-
-		case NSE_RESP_CODE_INVALID_SEQ_ID:
-			mgr.lo.Warn("Sequence ID is invalid, attempting to update")
-			expectedSeqID, err := extractExpectedSequenceID(r.ResponseDesc)
-			if err != nil {
-				mgr.lo.Error("Failed to extract expected sequence ID", "error", err)
-				return fmt.Errorf("failed to extract expected sequence ID: %v", err)
-			}
-			mgr.lo.Info("Expected sequence ID identified", "expected_seq_id", expectedSeqID)
-			mgr.Lock()
-			mgr.hwSeqID = expectedSeqID
-			mgr.Unlock()
-			return fmt.Errorf("sequence ID updated, retrying hardware metrics push")
-
-		default:
-			return fmt.Errorf("hardware metrics push failed with NSE response code %d", r.ResponseCode)
-		}
+// checkVersion warns when LAMA reports an API version other than the spec's,
+// once for every such version.
+func (mgr *Manager) checkVersion(versionNo string) {
+	if versionNo == "" || versionNo == mgr.opts.Spec.Version {
+		return
 	}
 
-	if r.ResponseCode == NSE_RESP_CODE_SUCCESS || r.ResponseCode == NSE_RESP_CODE_PARTIAL_SUCCESS {
-		mgr.Lock()
-		mgr.hwSeqID++
-		mgr.Unlock()
-	}
+	mgr.Lock()
+	seen := mgr.lamaVersion == versionNo
+	mgr.lamaVersion = versionNo
+	mgr.Unlock()
 
-	return nil
+	if !seen {
+		mgr.lo.Warn("LAMA API version differs from the spec, payloads may be rejected",
+			"spec_version", mgr.opts.Spec.Version, "lama_version", versionNo)
+	}
 }
 
-func (mgr *Manager) PushDBMetrics(locationID int, host string, data models.DBPromResp) error {
-	endpoint := fmt.Sprintf("%s%s", mgr.opts.URL, "/api/V1/metrics/database")
-
+// Credentials returns the login and member IDs of the current credentials.
+func (mgr *Manager) Credentials() (loginID, memberID string) {
 	mgr.RLock()
-	token := mgr.token
-	seqID := mgr.dbSeqID
-	mgr.RUnlock()
+	defer mgr.RUnlock()
 
-	dbPayload := createDatabaseReq(data, mgr.opts.MemberID, mgr.opts.ExchangeID, seqID, locationID, 1)
-
-	payload, err := json.Marshal(dbPayload)
-	if err != nil {
-		mgr.lo.Error("Failed to marshal database metrics payload", "error", err)
-		return fmt.Errorf("failed to marshal database metrics payload: %v", err)
-	}
-
-	mgr.lo.Info("Preparing to send database metrics", "host", host, "locationID", locationID, "URL", endpoint, "payload", string(payload), "headers", mgr.headers)
+	return mgr.opts.LoginID, mgr.opts.MemberID
+}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(payload))
-	if err != nil {
-		mgr.lo.Error("Failed to create HTTP request", "error", err)
-		return fmt.Errorf("failed to create HTTP request: %v", err)
-	}
+// memberID returns the member ID of the current credentials.
+func (mgr *Manager) memberID() string {
+	mgr.RLock()
+	defer mgr.RUnlock()
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	for k, v := range mgr.headers {
-		req.Header.Set(k, strings.Join(v, ","))
-	}
+	return mgr.opts.MemberID
+}
 
-	resp, err := mgr.client.Do(req)
-	if err != nil {
-		mgr.lo.Error("Database metrics HTTP request failed", "error", err)
-		return fmt.Errorf("database metrics HTTP request failed: %v", err)
+// Push sends a metrics request to a LAMA endpoint. The next sequence ID of
+// the endpoint is assigned to the request before it's sent, so a request can
+// be pushed again (eg: replayed from the spool) as is. If the endpoint's
+// circuit breaker is open, retry.ErrOpen is returned without sending anything.
+// The LAMA response, if any, is returned along with the error.
+func (mgr *Manager) Push(ctx context.Context, endpoint, host string, req MetricsReq) (MetricsResp, error) {
+	// LAMA rejects a payload without metrics, which would drop the interval.
+	if len(req.Payload) == 0 {
+		return MetricsResp{}, fmt.Errorf("%w: %s metrics request has no payload", ErrPermanent, endpoint)
+	}
+	for _, p := range req.Payload {
+		if len(p.MetricData) == 0 {
+			return MetricsResp{}, fmt.Errorf("%w: %s metrics request has no metric data", ErrPermanent, endpoint)
+		}
 	}
-	defer resp.Body.Close()
 
-	var r MetricsResp
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		mgr.lo.Error("Failed to unmarshal database metrics response", "error", err)
-		return fmt.Errorf("failed to unmarshal database metrics response: %v", err)
+	br := mgr.breaker(endpoint)
+	if err := br.Allow(); err != nil {
+		return MetricsResp{}, fmt.Errorf("%s metrics push skipped: %w", endpoint, err)
 	}
 
-	mgr.lo.Info("Received response for database metrics push", "response_code", r.ResponseCode, "response_description", r.ResponseDesc, "http_status", resp.StatusCode)
+	resp, err := mgr.push(ctx, endpoint, host, req)
 
-	if resp.StatusCode != http.StatusOK {
-		mgr.lo.Error("Database metrics push failed", "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "errors", r.Errors)
-		switch r.ResponseCode {
-		case NSE_RESP_CODE_INVALID_TOKEN, NSE_RESP_CODE_EXPIRED_TOKEN:
-			mgr.lo.Warn("Token is invalid or expired, attempting to log in again")
-			if err := mgr.Login(); err != nil {
-				mgr.lo.Error("Relogin attempt failed", "error", err)
-				return fmt.Errorf("failed to log in again: %v", err)
-			}
-			return fmt.Errorf("new token obtained after relogin, retrying database metrics push")
-
-		case NSE_RESP_CODE_INVALID_SEQ_ID:
-			mgr.lo.Warn("Sequence ID is invalid, attempting to update")
-			expectedSeqID, err := extractExpectedSequenceID(r.ResponseDesc)
-			if err != nil {
-				mgr.lo.Error("Failed to extract expected sequence ID", "error", err)
-				return fmt.Errorf("failed to extract expected sequence ID: %v", err)
-			}
-			mgr.lo.Info("Expected sequence ID identified", "expected_seq_id", expectedSeqID)
-			mgr.Lock()
-			mgr.dbSeqID = expectedSeqID
-			mgr.Unlock()
-			return fmt.Errorf("sequence ID has been updated, retrying database metrics push")
-
-		default:
-			mgr.lo.Error("Database metrics push failed with unhandled response code", "response_code", r.ResponseCode)
-			return fmt.Errorf("database metrics push failed with unhandled response code: %d", r.ResponseCode)
-		}
+	// A rejected token isn't a failure of the request, so it's pushed again
+	// right away with the new one. If that's rejected too, the error is
+	// left to the caller's retries.
+	if errors.Is(err, ErrTokenExpired) {
+		mgr.lo.Info("Pushing metrics again with the new session token", "endpoint", endpoint)
+		resp, err = mgr.push(ctx, endpoint, host, req)
 	}
 
-	if r.ResponseCode == NSE_RESP_CODE_SUCCESS || r.ResponseCode == NSE_RESP_CODE_PARTIAL_SUCCESS {
-		mgr.Lock()
-		mgr.dbSeqID++
-		mgr.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		br.Abort()
+	case errors.Is(err, ErrTransport):
+		// Including malformed responses.
+		br.Failure()
+	default:
+		// LAMA responded, even if it rejected the request.
+		br.Success()
 	}
 
-	return nil
+	return resp, err
 }
 
-// PushNetworkMetrics sends network metrics to NSE LAMA API.
-func (mgr *Manager) PushNetworkMetrics(locationID int, host string, data models.NetworkPromResp) error {
-	endpoint := fmt.Sprintf("%s%s", mgr.opts.URL, "/api/V1/metrics/network")
-
-	mgr.RLock()
-	token := mgr.token
-	seqID := mgr.netSeqID
-	mgr.RUnlock()
+// BreakerState returns the state of the circuit breaker of an endpoint.
+func (mgr *Manager) BreakerState(endpoint string) retry.State {
+	return mgr.breaker(endpoint).State()
+}
 
-	netPayload := createNetworkReq(data, mgr.opts.MemberID, mgr.opts.ExchangeID, seqID, locationID, 1)
+// breaker returns the circuit breaker of an endpoint, creating it if required.
+func (mgr *Manager) breaker(endpoint string) *retry.Breaker {
+	mgr.Lock()
+	defer mgr.Unlock()
 
-	payload, err := json.Marshal(netPayload)
-	if err != nil {
-		mgr.lo.Error("Failed to marshal network metrics payload", "error", err)
-		return fmt.Errorf("failed to marshal network metrics payload: %v", err)
+	b, ok := mgr.breakers[endpoint]
+	if !ok {
+		b = retry.NewBreaker(endpoint, mgr.opts.BreakerThreshold, mgr.opts.BreakerCooldown, mgr.onBreakerChange)
+		mgr.breakers[endpoint] = b
 	}
 
-	mgr.lo.Info("Preparing to send network metrics", "host", host, "locationID", locationID, "URL", endpoint, "payload", string(payload), "headers", mgr.headers)
+	return b
+}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(payload))
-	if err != nil {
-		mgr.lo.Error("Failed to create HTTP request", "error", err)
-		return fmt.Errorf("failed to create HTTP request: %v", err)
+func (mgr *Manager) onBreakerChange(endpoint string, from, to retry.State) {
+	switch to {
+	case retry.StateOpen:
+		mgr.lo.Error("Circuit breaker opened, pausing pushes", "endpoint", endpoint, "from", from.String(), "cooldown", mgr.opts.BreakerCooldown)
+	case retry.StateHalfOpen:
+		mgr.lo.Warn("Circuit breaker half-open, probing LAMA", "endpoint", endpoint)
+	case retry.StateClosed:
+		mgr.lo.Info("Circuit breaker closed, resuming pushes", "endpoint", endpoint)
 	}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	for k, v := range mgr.headers {
-		req.Header.Set(k, strings.Join(v, ","))
+func (mgr *Manager) push(ctx context.Context, endpoint, host string, req MetricsReq) (MetricsResp, error) {
+	cat, ok := mgr.opts.Spec.Category(endpoint)
+	if !ok {
+		return MetricsResp{}, fmt.Errorf("%w: unknown metrics category %q", ErrPermanent, endpoint)
 	}
+	url := mgr.opts.URL + cat.Path
 
-	resp, err := mgr.client.Do(req)
-	if err != nil {
-		mgr.lo.Error("Network metrics HTTP request failed", "error", err)
-		return fmt.Errorf("network metrics HTTP request failed: %v", err)
-	}
-	defer resp.Body.Close()
+	mgr.RLock()
+	token := mgr.token
+	mgr.RUnlock()
 
-	var r MetricsResp
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		mgr.lo.Error("Failed to unmarshal network metrics response", "error", err)
-		return fmt.Errorf("failed to unmarshal network metrics response: %v", err)
+	// Hold a sequence ID for the duration of the push. Unless it's committed
+	// or resynced below, it's released unconsumed for the next push.
+	seq, err := mgr.seqs.Reserve(ctx, endpoint)
+	if err != nil {
+		return MetricsResp{}, fmt.Errorf("failed to reserve %s sequence ID: %v", endpoint, err)
 	}
+	defer seq.Rollback()
 
-	mgr.lo.Info("Received response for network metrics push", "response_code", r.ResponseCode, "response_description", r.ResponseDesc, "http_status", resp.StatusCode)
-
-	if resp.StatusCode != http.StatusOK {
-		mgr.lo.Error("Network metrics push failed", "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "errors", r.Errors)
-		switch r.ResponseCode {
-		case NSE_RESP_CODE_INVALID_TOKEN, NSE_RESP_CODE_EXPIRED_TOKEN:
-			mgr.lo.Warn("Token is invalid or expired, attempting to log in again")
-			if err := mgr.Login(); err != nil {
-				mgr.lo.Error("Relogin attempt failed", "error", err)
-				return fmt.Errorf("failed to log in again: %v", err)
-			}
-			return fmt.Errorf("new token obtained after relogin, retrying network metrics push")
-
-		case NSE_RESP_CODE_INVALID_SEQ_ID:
-			mgr.lo.Warn("Sequence ID is invalid, attempting to update")
-			expectedSeqID, err := extractExpectedSequenceID(r.ResponseDesc)
-			if err != nil {
-				mgr.lo.Error("Failed to extract expected sequence ID", "error", err)
-				return fmt.Errorf("failed to extract expected sequence ID: %v", err)
-			}
-			mgr.lo.Info("Expected sequence ID identified", "expected_seq_id", expectedSeqID)
-			mgr.Lock()
-			mgr.netSeqID = expectedSeqID
-			mgr.Unlock()
-			return fmt.Errorf("sequence ID has been updated, retrying network metrics push")
-
-		default:
-			mgr.lo.Error("Network metrics push failed with unhandled response code", "response_code", r.ResponseCode)
-			return fmt.Errorf("network metrics push failed with unhandled response code: %d", r.ResponseCode)
-		}
-	}
+	req.SequenceID = seq.ID
 
-	if r.ResponseCode == NSE_RESP_CODE_SUCCESS || r.ResponseCode == NSE_RESP_CODE_PARTIAL_SUCCESS {
-		mgr.Lock()
-		mgr.netSeqID++
-		mgr.Unlock()
+	if mgr.opts.DryRun != nil {
+		return mgr.writeDryRun(seq, endpoint, url, host, req)
 	}
 
-	return nil
-}
-
-// PushAppMetrics sends app metrics to NSE LAMA API.
-func (mgr *Manager) PushAppMetrics(locationID int, host string, data models.AppPromResp) error {
-	endpoint := fmt.Sprintf("%s%s", mgr.opts.URL, "/api/V1/metrics/application")
-
-	mgr.RLock()
-	token := mgr.token
-	seqID := mgr.netSeqID
-	mgr.RUnlock()
-
-	appPayload := createAppReq(data, mgr.opts.MemberID, mgr.opts.ExchangeID, seqID, locationID, 1)
-
-	payload, err := json.Marshal(appPayload)
+	payload, err := json.Marshal(req)
 	if err != nil {
-		mgr.lo.Error("Failed to marshal app metrics payload", "error", err)
-		return fmt.Errorf("failed to marshal app metrics payload: %v", err)
+		mgr.lo.Error("Failed to marshal metrics payload", "endpoint", endpoint, "error", err)
+		return MetricsResp{}, fmt.Errorf("%w: failed to marshal %s metrics payload: %v", ErrPermanent, endpoint, err)
 	}
 
-	mgr.lo.Info("Preparing to send app metrics", "host", host, "locationID", locationID, "URL", endpoint, "payload", string(payload), "headers", mgr.headers)
+	mgr.lo.Info("Preparing to send metrics", "endpoint", endpoint, "host", host, "locationID", req.LocationID, "URL", url, "payload", string(payload), "headers", mgr.headers)
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(payload))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
 	if err != nil {
 		mgr.lo.Error("Failed to create HTTP request", "error", err)
-		return fmt.Errorf("failed to create HTTP request: %v", err)
+		return MetricsResp{}, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	for k, v := range mgr.headers {
-		req.Header.Set(k, strings.Join(v, ","))
+		httpReq.Header.Set(k, strings.Join(v, ","))
 	}
 
-	resp, err := mgr.client.Do(req)
+	resp, err := mgr.client.Do(httpReq)
 	if err != nil {
-		mgr.lo.Error("App metrics HTTP request failed", "error", err)
-		return fmt.Errorf("app metrics HTTP request failed: %v", err)
+		mgr.lo.Error("Metrics HTTP request failed", "endpoint", endpoint, "error", err)
+		return MetricsResp{}, fmt.Errorf("%w: %s metrics HTTP request failed: %v", ErrTransport, endpoint, err)
 	}
 	defer resp.Body.Close()
 
 	var r MetricsResp
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		mgr.lo.Error("Failed to unmarshal app metrics response", "error", err)
-		return fmt.Errorf("failed to unmarshal app metrics response: %v", err)
+		mgr.lo.Error("Failed to unmarshal metrics response", "endpoint", endpoint, "error", err)
+		return r, fmt.Errorf("%w: %w: failed to unmarshal %s metrics response (HTTP %d): %v", ErrTransport, ErrMalformedResponse, endpoint, resp.StatusCode, err)
 	}
+	mgr.checkVersion(r.VersionNo)
 
-	mgr.lo.Info("Received response for app metrics push", "response_code", r.ResponseCode, "response_description", r.ResponseDesc, "http_status", resp.StatusCode)
+	mgr.lo.Info("Received response for metrics push", "endpoint", endpoint, "response_code", r.ResponseCode, "response_description", r.ResponseDesc, "http_status", resp.StatusCode)
 
-	if resp.StatusCode != http.StatusOK {
-		mgr.lo.Error("App metrics push failed", "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "errors", r.Errors)
-		switch r.ResponseCode {
-		case NSE_RESP_CODE_INVALID_TOKEN, NSE_RESP_CODE_EXPIRED_TOKEN:
-			mgr.lo.Warn("Token is invalid or expired, attempting to log in again")
-			if err := mgr.Login(); err != nil {
-				mgr.lo.Error("Relogin attempt failed", "error", err)
-				return fmt.Errorf("failed to log in again: %v", err)
-			}
-			return fmt.Errorf("new token obtained after relogin, retrying app metrics push")
-
-		case NSE_RESP_CODE_INVALID_SEQ_ID:
-			mgr.lo.Warn("Sequence ID is invalid, attempting to update")
-			expectedSeqID, err := extractExpectedSequenceID(r.ResponseDesc)
-			if err != nil {
-				mgr.lo.Error("Failed to extract expected sequence ID", "error", err)
-				return fmt.Errorf("failed to extract expected sequence ID: %v", err)
-			}
-			mgr.lo.Info("Expected sequence ID identified", "expected_seq_id", expectedSeqID)
-			mgr.Lock()
-			mgr.netSeqID = expectedSeqID
-			mgr.Unlock()
-			return fmt.Errorf("sequence ID has been updated, retrying app metrics push")
-
-		default:
-			mgr.lo.Error("App metrics push failed with unhandled response code", "response_code", r.ResponseCode)
-			return fmt.Errorf("app metrics push failed with unhandled response code: %d", r.ResponseCode)
-		}
+	// LAMA may report a failure with HTTP 200, so the response code decides
+	// the outcome.
+	if resp.StatusCode == http.StatusOK && (r.ResponseCode == NSE_RESP_CODE_SUCCESS || r.ResponseCode == NSE_RESP_CODE_PARTIAL_SUCCESS) {
+		seq.Commit()
+		return r, nil
 	}
 
-	if r.ResponseCode == NSE_RESP_CODE_SUCCESS || r.ResponseCode == NSE_RESP_CODE_PARTIAL_SUCCESS {
-		mgr.Lock()
-		mgr.netSeqID++
-		mgr.Unlock()
-	}
+	mgr.lo.Error("Metrics push failed", "endpoint", endpoint, "response_code", r.ResponseCode, "response_desc", r.ResponseDesc, "errors", r.Errors, "http_status", resp.StatusCode)
+	switch r.ResponseCode {
+	case NSE_RESP_CODE_INVALID_TOKEN, NSE_RESP_CODE_EXPIRED_TOKEN:
+		mgr.lo.Warn("Token is invalid or expired, attempting to log in again")
+		if err := mgr.refreshToken(ctx, token); err != nil {
+			mgr.lo.Error("Relogin attempt failed", "error", err)
 
-	return nil
-}
+			// Only the login was rejected, not the request, so it
+			// isn't returned as an ErrPermanent, which would drop the
+			// request. ErrLoginLocked is, as the request is kept for it.
+			if errors.Is(err, ErrPermanent) && !errors.Is(err, ErrLoginLocked) {
+				return r, fmt.Errorf("failed to log in again: %v", err)
+			}
+			return r, fmt.Errorf("failed to log in again: %w", err)
+		}
+		return r, fmt.Errorf("%w, new token obtained for %s metrics push", ErrTokenExpired, endpoint)
 
-func createNetworkReq(metrics models.NetworkPromResp, memberId string, exchangeId, sequenceId, locationID, applicationId int) NetworkReq {
-	return NetworkReq{
-		MemberID:   memberId,
-		ExchangeID: exchangeId,
-		SequenceID: sequenceId,
-		LocationID: locationID,
-		Timestamp:  time.Now().Unix(),
-		Payload: []MetricPayload{
-			{
-				ApplicationID: applicationId,
-				MetricData: []MetricData{
-					newMetricData("packetCount", float64(metrics.PacketErrors), true),
-					newMetricData("bandwidth", 0.0, false),
-				},
-			},
-		},
+	case NSE_RESP_CODE_INVALID_SEQ_ID:
+		mgr.lo.Warn("Sequence ID is invalid, attempting to update")
+		expectedSeqID, err := extractExpectedSequenceID(r.ResponseDesc)
+		if err != nil {
+			mgr.lo.Error("Failed to extract expected sequence ID", "error", err)
+			return r, &ErrRejected{HTTPStatus: resp.StatusCode, Code: r.ResponseCode, Desc: r.ResponseDesc, Errors: r.Errors}
+		}
+		mgr.lo.Info("Expected sequence ID identified", "expected_seq_id", expectedSeqID)
+		seq.Resync(expectedSeqID)
+		return r, &ErrSequenceMismatch{Expected: expectedSeqID}
+
+	default:
+		mgr.lo.Error("Metrics push failed with unhandled response code", "endpoint", endpoint, "response_code", r.ResponseCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return r, fmt.Errorf("%w: %s metrics push failed with HTTP %d and response code: %d", ErrTransport, endpoint, resp.StatusCode, r.ResponseCode)
+		}
+		return r, &ErrRejected{HTTPStatus: resp.StatusCode, Code: r.ResponseCode, Desc: r.ResponseDesc, Errors: r.Errors}
 	}
 }
 
-func createAppReq(metrics models.AppPromResp, memberId string, exchangeId, sequenceId, locationID, applicationId int) AppReq {
-	return AppReq{
-		MemberID:   memberId,
-		ExchangeID: exchangeId,
-		SequenceID: sequenceId,
-		LocationID: locationID,
-		Timestamp:  time.Now().Unix(),
-		Payload: []MetricPayload{
-			{
-				ApplicationID: applicationId,
-				MetricData: []MetricData{
-					newMetricData("throughput", float64(metrics.Throughput), false),
-					newMetricData("failureTradeApi", float64(metrics.FailureCount), true),
-					newMetricData("latency", 0.0, false),
-					newMetricData("failureAuthentication", 0.0, true),
-				},
-			},
-		},
+// writeDryRun writes a request that would have been pushed to the dry run
+// writer and reports it as accepted.
+func (mgr *Manager) writeDryRun(seq *SeqReservation, endpoint, url, host string, req MetricsReq) (MetricsResp, error) {
+	b, err := json.MarshalIndent(struct {
+		Endpoint string     `json:"endpoint"`
+		URL      string     `json:"url"`
+		Host     string     `json:"host"`
+		Request  MetricsReq `json:"request"`
+	}{endpoint, url, host, req}, "", "  ")
+	if err != nil {
+		return MetricsResp{}, fmt.Errorf("%w: failed to marshal %s metrics payload: %v", ErrPermanent, endpoint, err)
 	}
-}
 
-func createHardwareReq(metrics models.HWPromResp, memberId string, exchangeId, sequenceId, locationID, applicationId int) HardwareReq {
-	return HardwareReq{
-		MemberID:   memberId,
-		ExchangeID: exchangeId,
-		SequenceID: sequenceId,
-		LocationID: locationID,
-		Timestamp:  time.Now().Unix(),
-		Payload: []MetricPayload{
-			{
-				ApplicationID: applicationId,
-				MetricData: []MetricData{
-					newMetricData("cpu", metrics.CPU, false),
-					newMetricData("memory", metrics.Mem, false),
-					newMetricData("disk", metrics.Disk, false),
-					newMetricData("uptime", metrics.Uptime, false),
-				},
-			},
-		},
+	if _, err := mgr.opts.DryRun.Write(append(b, '\n')); err != nil {
+		return MetricsResp{}, fmt.Errorf("failed to write %s dry run payload: %v", endpoint, err)
 	}
-}
+	seq.Commit()
 
-func createDatabaseReq(metrics models.DBPromResp, memberId string, exchangeId, sequenceId, locationID, applicationId int) DatabaseReq {
-	return DatabaseReq{
-		MemberID:   memberId,
-		ExchangeID: exchangeId,
-		SequenceID: sequenceId,
-		LocationID: locationID,
-		Timestamp:  time.Now().Unix(),
-		Payload: []MetricPayload{
-			{
-				ApplicationID: applicationId,
-				MetricData: []MetricData{
-					newMetricData("status", float64(metrics.Status), true),
-					newMetricData("latency", 0.0, false),
-					newMetricData("qSize", 0.0, false),
-					newMetricData("bandwidth", 0.0, false),
-				},
-			},
-		},
-	}
+	return MetricsResp{
+		Timestamp:    time.Now().Unix(),
+		ResponseCode: NSE_RESP_CODE_SUCCESS,
+		ResponseDesc: "dry run",
+	}, nil
 }
 
 // extractExpectedSequenceID extracts the expected SequenceID value from a provided
@@ -681,38 +741,77 @@ func extractExpectedSequenceID(desc string) (int, error) {
 	return strconv.Atoi(matches[1])
 }
 
-// Function to create a new MetricData.
-func newMetricData(key string, avg float64, simple bool) MetricData {
+// newMetricData creates a new MetricData from the samples of a measure. A
+// simple measure is reported as its latest sample, the rest as the min, max,
+// mean and median of all the samples. If there are no samples, the value is
+// left nil.
+func newMetricData(m Measure, samples []float64) MetricData {
 	var value interface{}
-	if simple {
-		value = avg
-	} else {
-		var strValue string
-		switch key {
-		case "uptime":
-			strValue = fmt.Sprintf("%.0f", avg)
-		default:
-			strValue = fmt.Sprintf("%.2f", avg)
-		}
-
-		// Convert the string back to a float64.
-		data, err := strconv.ParseFloat(strValue, 64)
-		if err != nil {
-			// TODO: Handle error. For now fallback to original value.
-			fmt.Println("failed to convert string to float64", "value", strValue, "error", err, "key", key, "avg", avg)
-			data = avg
-		}
-
+	switch {
+	case len(samples) == 0:
+		// Not applicable. Left out of the payload by present().
+	case m.Kind == Simple:
+		value = samples[len(samples)-1]
+	default:
+		v := summarize(samples)
 		value = MetricValue{
-			Min: data,
-			Max: data,
-			Avg: data,
-			Med: data,
+			Min: m.round(v.Min),
+			Max: m.round(v.Max),
+			Avg: m.round(v.Avg),
+			Med: m.round(v.Med),
 		}
 	}
 
 	return MetricData{
-		Key:   key,
+		Key:   m.Key,
 		Value: value,
 	}
 }
+
+// present returns the metrics that have a value, leaving out the ones that are
+// not applicable instead of reporting them as 0.
+func present(data ...MetricData) []MetricData {
+	out := make([]MetricData, 0, len(data))
+	for _, d := range data {
+		if d.Value != nil {
+			out = append(out, d)
+		}
+	}
+
+	return out
+}
+
+// summarize computes the min, max, mean and median of samples.
+func summarize(samples []float64) MetricValue {
+	if len(samples) == 0 {
+		return MetricValue{}
+	}
+
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	n := len(sorted)
+	med := sorted[n/2]
+	if n%2 == 0 {
+		med = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	return MetricValue{
+		Min: sorted[0],
+		Max: sorted[n-1],
+		Avg: sum / float64(n),
+		Med: med,
+	}
+}
+
+// round rounds v to the given number of decimal places.
+func round(v float64, precision int) float64 {
+	p := math.Pow(10, float64(precision))
+	return math.Round(v*p) / p
+}
@@ -0,0 +1,228 @@
+package nse_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/nse"
+	"github.com/zerodha/mii-lama/internal/nse/mock"
+	"github.com/zerodha/mii-lama/internal/retry"
+	"github.com/zerodha/mii-lama/pkg/models"
+	"golang.org/x/exp/slog"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+var testOpts = mock.Opts{
+	MemberID:   "member",
+	LoginID:    "login",
+	Password:   "password",
+	ExchangeID: 1,
+}
+
+// newTestManager returns a manager for the LAMA API at url.
+func newTestManager(t *testing.T, url string) *nse.Manager {
+	t.Helper()
+
+	mgr, err := nse.New(testLogger, nse.Opts{
+		URL:              url,
+		LoginID:          testOpts.LoginID,
+		MemberID:         testOpts.MemberID,
+		ExchangeID:       testOpts.ExchangeID,
+		Password:         testOpts.Password,
+		Timeout:          5 * time.Second,
+		MaxLoginAttempts: 3,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return mgr
+}
+
+// testRequest returns a valid request for a category.
+func testRequest(t *testing.T, mgr *nse.Manager, category string) nse.MetricsReq {
+	t.Helper()
+
+	cat, ok := mgr.Spec().Category(category)
+	if !ok {
+		t.Fatalf("no %s category in the spec", category)
+	}
+
+	samples := make(models.Samples, len(cat.Measures))
+	for _, m := range cat.Measures {
+		samples[m.Query] = []float64{10, 20, 30}
+	}
+
+	return mgr.NewRequest(cat, 1, samples)
+}
+
+func TestPushLoginRejected(t *testing.T) {
+	var (
+		lama        = mock.New(testOpts, testLogger)
+		rejectLogin atomic.Bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/V1/auth/login" && rejectLogin.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lama.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	mgr := newTestManager(t, srv.URL)
+	if err := mgr.Login(ctx); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	// The session token expires, and the login that refreshes it is
+	// rejected.
+	lama.ExpireTokens()
+	rejectLogin.Store(true)
+
+	_, err := mgr.Push(ctx, "hardware", "host", testRequest(t, mgr, "hardware"))
+	if err == nil {
+		t.Fatal("Push() error = nil, want the login error")
+	}
+	if errors.Is(err, nse.ErrPermanent) {
+		t.Errorf("Push() error = %v, the request wasn't rejected, only the login", err)
+	}
+	if !nse.IsRetryable(err) {
+		t.Errorf("IsRetryable(%v) = false, want true", err)
+	}
+}
+
+func TestPushResponseCode(t *testing.T) {
+	var (
+		seq *nse.ErrSequenceMismatch
+		rej *nse.ErrRejected
+	)
+
+	tests := []struct {
+		name   string
+		status int
+		code   int
+		desc   string
+
+		// check reports whether the error returned by Push is the expected
+		// one.
+		check func(err error) bool
+	}{
+		{"success", http.StatusOK, nse.NSE_RESP_CODE_SUCCESS, "", func(err error) bool { return err == nil }},
+		{"partial success", http.StatusOK, nse.NSE_RESP_CODE_PARTIAL_SUCCESS, "", func(err error) bool { return err == nil }},
+		{"sequence mismatch with HTTP 200", http.StatusOK, nse.NSE_RESP_CODE_INVALID_SEQ_ID, "Invalid SequenceId. SequenceId should be 5", func(err error) bool {
+			return errors.As(err, &seq) && seq.Expected == 5
+		}},
+		{"expired token with HTTP 200", http.StatusOK, nse.NSE_RESP_CODE_EXPIRED_TOKEN, "", func(err error) bool {
+			return errors.Is(err, nse.ErrTokenExpired)
+		}},
+		{"unknown code with HTTP 200", http.StatusOK, 603, "Invalid payload", func(err error) bool {
+			return errors.As(err, &rej) && rej.Code == 603
+		}},
+		{"unknown code with HTTP 503", http.StatusServiceUnavailable, 603, "", func(err error) bool {
+			return errors.Is(err, nse.ErrTransport)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lama := mock.New(testOpts, testLogger)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/V1/auth/login" {
+					lama.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				json.NewEncoder(w).Encode(nse.MetricsResp{ResponseCode: tt.code, ResponseDesc: tt.desc})
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			mgr := newTestManager(t, srv.URL)
+			if err := mgr.Login(ctx); err != nil {
+				t.Fatalf("Login() error = %v", err)
+			}
+
+			_, err := mgr.Push(ctx, "hardware", "host", testRequest(t, mgr, "hardware"))
+			if !tt.check(err) {
+				t.Errorf("Push() error = %v (%s)", err, nse.ErrorType(err))
+			}
+		})
+	}
+}
+
+func TestPushTokenExpiredConcurrent(t *testing.T) {
+	const pushesPerCategory = 5
+
+	var (
+		lama   = mock.New(testOpts, testLogger)
+		logins atomic.Int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/V1/auth/login" {
+			logins.Add(1)
+		}
+		lama.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	mgr := newTestManager(t, srv.URL)
+	if err := mgr.Login(ctx); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	// Every push is rejected with 802 until the token is refreshed.
+	lama.ExpireTokens()
+	logins.Store(0)
+
+	// A single attempt per push, so a re-push that counted against the
+	// retries would fail.
+	p := retry.Policy{MaxAttempts: 1, Retryable: nse.IsRetryable}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, len(mgr.Spec().Categories)*pushesPerCategory)
+	)
+	for _, c := range mgr.Spec().Categories {
+		for i := 0; i < pushesPerCategory; i++ {
+			req := testRequest(t, mgr, c.Name)
+
+			wg.Add(1)
+			go func(endpoint string) {
+				defer wg.Done()
+				errs <- p.Do(ctx, func(ctx context.Context) error {
+					_, err := mgr.Push(ctx, endpoint, "host", req)
+					return err
+				})
+			}(c.Name)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Push() error = %v, want nil", err)
+		}
+	}
+	if n := logins.Load(); n != 1 {
+		t.Errorf("%d logins after the token expired, want 1", n)
+	}
+	for _, c := range mgr.Spec().Categories {
+		if n := lama.Stats().Accepted[c.Name]; n != pushesPerCategory {
+			t.Errorf("%d %s requests accepted, want %d", n, c.Name, pushesPerCategory)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package nse
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/zerodha/mii-lama/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+// SeqTracker hands out LAMA sequence IDs, with a separate counter for every
+// endpoint. An ID is reserved before a push and is then either committed once
+// LAMA acknowledges it, resynced to the ID LAMA expects, or rolled back if the
+// push fails. Only one ID per endpoint is in flight at any time, so concurrent
+// pushes to the same endpoint never send duplicate IDs.
+type SeqTracker struct {
+	sync.Mutex
+
+	lo    *slog.Logger
+	store state.Store
+	seqs  map[string]*seqCounter
+}
+
+// SeqStats is a snapshot of the sequence ID counter of an endpoint.
+type SeqStats struct {
+	// Next is the sequence ID that will be sent in the next push.
+	Next int `json:"next"`
+
+	// Gaps is the number of IDs skipped when LAMA asked for a higher
+	// sequence ID than the one that was sent.
+	Gaps int `json:"gaps"`
+
+	// Duplicates is the number of IDs that will be sent again because LAMA
+	// asked for a lower sequence ID than the one that was sent.
+	Duplicates int `json:"duplicates"`
+}
+
+// SeqReservation is a sequence ID reserved for a single push. It must be
+// released with exactly one of Commit, Resync or Rollback. Once released,
+// further calls are no-ops, which allows a deferred Rollback.
+type SeqReservation struct {
+	ID int
+
+	endpoint string
+	t        *SeqTracker
+	c        *seqCounter
+	done     bool
+}
+
+type seqCounter struct {
+	// lock is held for as long as an ID of the endpoint is reserved.
+	lock chan struct{}
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	next       int
+	gaps       int
+	duplicates int
+}
+
+// NewSeqTracker returns a tracker for the given endpoints. If store is not
+// nil, the counters resume from the last acknowledged IDs in it and every
+// committed ID is saved to it.
+func NewSeqTracker(store state.Store, lo *slog.Logger, endpoints ...string) (*SeqTracker, error) {
+	t := &SeqTracker{
+		lo:    lo,
+		store: store,
+		seqs:  make(map[string]*seqCounter, len(endpoints)),
+	}
+
+	var last map[string]int
+	if store != nil {
+		l, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sequence IDs from state store: %v", err)
+		}
+		last = l
+	}
+
+	for _, ep := range endpoints {
+		c := t.counter(ep)
+		if id, ok := last[ep]; ok {
+			c.next = id + 1
+		}
+	}
+
+	return t, nil
+}
+
+// Reserve reserves the next sequence ID of an endpoint. It blocks while
+// another ID of the same endpoint is reserved, or until ctx is done.
+func (t *SeqTracker) Reserve(ctx context.Context, endpoint string) (*SeqReservation, error) {
+	c := t.counter(endpoint)
+	select {
+	case c.lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.mu.Lock()
+	id := c.next
+	c.mu.Unlock()
+
+	return &SeqReservation{
+		ID:       id,
+		endpoint: endpoint,
+		t:        t,
+		c:        c,
+	}, nil
+}
+
+// Stats returns a snapshot of the counters of all endpoints.
+func (t *SeqTracker) Stats() map[string]SeqStats {
+	t.Lock()
+	defer t.Unlock()
+
+	out := make(map[string]SeqStats, len(t.seqs))
+	for ep, c := range t.seqs {
+		c.mu.Lock()
+		out[ep] = SeqStats{
+			Next:       c.next,
+			Gaps:       c.gaps,
+			Duplicates: c.duplicates,
+		}
+		c.mu.Unlock()
+	}
+
+	return out
+}
+
+// Commit marks the reserved ID as acknowledged by LAMA, advances the counter
+// and saves the ID to the state store.
+func (r *SeqReservation) Commit() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	r.c.mu.Lock()
+	r.c.next = r.ID + 1
+	r.c.mu.Unlock()
+
+	// Save while the endpoint is still locked so that stored IDs never go back.
+	// A failure is only logged as the push itself has already succeeded.
+	if r.t.store != nil {
+		if err := r.t.store.Save(r.endpoint, r.ID); err != nil {
+			r.t.lo.Error("Failed to save sequence ID to state store", "endpoint", r.endpoint, "seq_id", r.ID, "error", err)
+		}
+	}
+
+	<-r.c.lock
+}
+
+// Resync releases the reserved ID and sets the counter to the sequence ID
+// that LAMA expects, recording the resulting gap or duplicates.
+func (r *SeqReservation) Resync(expected int) {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	r.c.mu.Lock()
+	switch {
+	case expected > r.ID:
+		r.c.gaps += expected - r.ID
+	case expected < r.ID:
+		r.c.duplicates += r.ID - expected
+	}
+	r.c.next = expected
+	r.c.mu.Unlock()
+	<-r.c.lock
+
+	switch {
+	case expected > r.ID:
+		r.t.lo.Warn("Sequence ID gap detected", "endpoint", r.endpoint, "sent_seq_id", r.ID, "expected_seq_id", expected, "skipped", expected-r.ID)
+	case expected < r.ID:
+		r.t.lo.Warn("Sequence ID rewind detected, IDs will be resent", "endpoint", r.endpoint, "sent_seq_id", r.ID, "expected_seq_id", expected, "duplicates", r.ID-expected)
+	}
+}
+
+// Rollback releases the reserved ID without consuming it.
+func (r *SeqReservation) Rollback() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	<-r.c.lock
+}
+
+// counter returns the counter of an endpoint, creating it if required.
+func (t *SeqTracker) counter(endpoint string) *seqCounter {
+	t.Lock()
+	defer t.Unlock()
+
+	c, ok := t.seqs[endpoint]
+	if !ok {
+		c = &seqCounter{
+			lock: make(chan struct{}, 1),
+			next: 1,
+		}
+		t.seqs[endpoint] = c
+	}
+
+	return c
+}
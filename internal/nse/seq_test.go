@@ -0,0 +1,268 @@
+package nse
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zerodha/mii-lama/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestSeqTracker(t *testing.T) {
+	tests := []struct {
+		name  string
+		saved map[string]int
+
+		// release releases the reservation of every push in turn, which
+		// reserves the next ID of the endpoint.
+		release []func(r *SeqReservation)
+
+		want      []int
+		stats     SeqStats
+		wantSaved int
+	}{
+		{
+			name: "commit",
+			release: []func(r *SeqReservation){
+				(*SeqReservation).Commit,
+				(*SeqReservation).Commit,
+				(*SeqReservation).Commit,
+			},
+			want:      []int{1, 2, 3},
+			stats:     SeqStats{Next: 4},
+			wantSaved: 3,
+		},
+		{
+			name:  "resume from the store",
+			saved: map[string]int{"hardware": 41},
+			release: []func(r *SeqReservation){
+				(*SeqReservation).Commit,
+				(*SeqReservation).Commit,
+			},
+			want:      []int{42, 43},
+			stats:     SeqStats{Next: 44},
+			wantSaved: 43,
+		},
+		{
+			name: "rollback",
+			release: []func(r *SeqReservation){
+				(*SeqReservation).Rollback,
+				(*SeqReservation).Commit,
+				(*SeqReservation).Rollback,
+			},
+			want:      []int{1, 1, 2},
+			stats:     SeqStats{Next: 2},
+			wantSaved: 1,
+		},
+		{
+			name: "resync to a gap",
+			release: []func(r *SeqReservation){
+				func(r *SeqReservation) { r.Resync(10) },
+				(*SeqReservation).Commit,
+			},
+			want:      []int{1, 10},
+			stats:     SeqStats{Next: 11, Gaps: 9},
+			wantSaved: 10,
+		},
+		{
+			name:  "resync to a rewind",
+			saved: map[string]int{"hardware": 9},
+			release: []func(r *SeqReservation){
+				func(r *SeqReservation) { r.Resync(7) },
+				(*SeqReservation).Commit,
+			},
+			want:      []int{10, 7},
+			stats:     SeqStats{Next: 8, Duplicates: 3},
+			wantSaved: 7,
+		},
+		{
+			name: "release once",
+			release: []func(r *SeqReservation){
+				func(r *SeqReservation) { r.Commit(); r.Rollback(); r.Resync(1) },
+				func(r *SeqReservation) { r.Rollback(); r.Commit() },
+			},
+			want:      []int{1, 2},
+			stats:     SeqStats{Next: 2},
+			wantSaved: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := state.NewMemoryStore()
+			for ep, id := range tt.saved {
+				store.Save(ep, id)
+			}
+
+			seqs, err := NewSeqTracker(store, testLogger, "hardware")
+			if err != nil {
+				t.Fatalf("NewSeqTracker() error = %v", err)
+			}
+
+			var got []int
+			for _, release := range tt.release {
+				r, err := seqs.Reserve(context.Background(), "hardware")
+				if err != nil {
+					t.Fatalf("Reserve() error = %v", err)
+				}
+				got = append(got, r.ID)
+				release(r)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("reserved %v, want %v", got, tt.want)
+			}
+
+			if s := seqs.Stats()["hardware"]; s != tt.stats {
+				t.Errorf("Stats() = %+v, want %+v", s, tt.stats)
+			}
+
+			saved, _ := store.Load()
+			if saved["hardware"] != tt.wantSaved {
+				t.Errorf("saved %d, want %d", saved["hardware"], tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestSeqTrackerConcurrent(t *testing.T) {
+	const pushes = 50
+
+	tests := []struct {
+		name string
+		// release releases the reservation of the ith push, and returns
+		// true if the ID was committed.
+		release func(i int, r *SeqReservation) bool
+		next    int
+	}{
+		{
+			name: "commit",
+			release: func(i int, r *SeqReservation) bool {
+				r.Commit()
+				return true
+			},
+			next: pushes + 1,
+		},
+		{
+			name: "commit and rollback",
+			release: func(i int, r *SeqReservation) bool {
+				if i%2 == 0 {
+					r.Rollback()
+					return false
+				}
+				r.Commit()
+				return true
+			},
+			next: pushes/2 + 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seqs, err := NewSeqTracker(state.NewMemoryStore(), testLogger, "hardware", "network")
+			if err != nil {
+				t.Fatalf("NewSeqTracker() error = %v", err)
+			}
+
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				committed = make(map[string]map[int]bool)
+				inFlight  = make(map[string]int)
+			)
+			for _, ep := range []string{"hardware", "network"} {
+				committed[ep] = make(map[int]bool)
+				for i := 0; i < pushes; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						r, err := seqs.Reserve(context.Background(), ep)
+						if err != nil {
+							t.Errorf("Reserve() error = %v", err)
+							return
+						}
+
+						mu.Lock()
+						inFlight[ep]++
+						if inFlight[ep] > 1 {
+							t.Errorf("%d IDs of %s reserved at once", inFlight[ep], ep)
+						}
+						mu.Unlock()
+
+						// Give the other pushes a chance to run.
+						time.Sleep(time.Millisecond)
+
+						mu.Lock()
+						inFlight[ep]--
+						mu.Unlock()
+
+						id := r.ID
+						if !tt.release(i, r) {
+							return
+						}
+
+						mu.Lock()
+						if committed[ep][id] {
+							t.Errorf("ID %d of %s committed twice", id, ep)
+						}
+						committed[ep][id] = true
+						mu.Unlock()
+					}()
+				}
+			}
+			wg.Wait()
+
+			for ep, ids := range committed {
+				if len(ids) != tt.next-1 {
+					t.Errorf("%d IDs of %s committed, want %d", len(ids), ep, tt.next-1)
+				}
+				if n := seqs.Stats()[ep].Next; n != tt.next {
+					t.Errorf("next ID of %s = %d, want %d", ep, n, tt.next)
+				}
+			}
+		})
+	}
+}
+
+func TestSeqTrackerReserveCancel(t *testing.T) {
+	seqs, err := NewSeqTracker(nil, testLogger, "hardware")
+	if err != nil {
+		t.Fatalf("NewSeqTracker() error = %v", err)
+	}
+
+	r, err := seqs.Reserve(context.Background(), "hardware")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+
+	// Another reservation waits for the first to be released.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := seqs.Reserve(ctx, "hardware"); err != context.DeadlineExceeded {
+		t.Fatalf("Reserve() error = %v while reserved, want %v", err, context.DeadlineExceeded)
+	}
+
+	reserved := make(chan int)
+	go func() {
+		r, err := seqs.Reserve(context.Background(), "hardware")
+		if err != nil {
+			t.Errorf("Reserve() error = %v", err)
+			close(reserved)
+			return
+		}
+		defer r.Rollback()
+		reserved <- r.ID
+	}()
+
+	r.Commit()
+	if id := <-reserved; id != 2 {
+		t.Errorf("reserved %d after commit, want 2", id)
+	}
+}
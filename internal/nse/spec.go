@@ -0,0 +1,214 @@
+package nse
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/v2"
+)
+
+// defaultSpecFile is the spec that's used unless another one is loaded.
+//
+//go:embed spec.toml
+var defaultSpecFile []byte
+
+// Kinds of measures in a spec file.
+const (
+	kindSimple  = "simple"
+	kindSummary = "summary"
+)
+
+// maxPrecision is the maximum number of decimal places of a measure.
+const maxPrecision = 6
+
+// reCategoryName matches the valid names of categories, which are used in
+// config keys and metric labels.
+var reCategoryName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Spec is the specification of the LAMA metrics API: the metrics categories
+// and the measures reported for them.
+type Spec struct {
+	// Version is the version of the LAMA API the spec describes. It's
+	// compared with the versionNo of LAMA responses.
+	Version string
+
+	// Categories are synced in this order.
+	Categories []Category
+}
+
+// specFile is the structure of a spec file.
+type specFile struct {
+	Version    string `koanf:"version"`
+	Categories []struct {
+		Name     string `koanf:"name"`
+		Path     string `koanf:"path"`
+		Measures []struct {
+			Key       string `koanf:"key"`
+			Query     string `koanf:"query"`
+			Kind      string `koanf:"kind"`
+			Precision *int   `koanf:"precision"`
+			Percent   bool   `koanf:"percent"`
+			Required  bool   `koanf:"required"`
+		} `koanf:"measures"`
+	} `koanf:"categories"`
+}
+
+// specBytes is a koanf provider for a spec file that has been read.
+type specBytes []byte
+
+func (b specBytes) ReadBytes() ([]byte, error) {
+	return b, nil
+}
+
+func (b specBytes) Read() (map[string]interface{}, error) {
+	return nil, errors.New("specBytes provider does not support Read()")
+}
+
+// DefaultSpec returns the spec embedded in mii-lama.
+func DefaultSpec() *Spec {
+	s, err := parseSpec(defaultSpecFile, toml.Parser())
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded LAMA spec: %v", err))
+	}
+
+	return s
+}
+
+// LoadSpec loads a spec from a TOML or YAML file. If path is empty, it
+// returns the default spec.
+func LoadSpec(path string) (*Spec, error) {
+	if path == "" {
+		return DefaultSpec(), nil
+	}
+
+	var parser koanf.Parser
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		parser = toml.Parser()
+	case ".yaml", ".yml":
+		parser = yaml.Parser()
+	default:
+		return nil, fmt.Errorf("unsupported LAMA spec format %s, use .toml or .yaml", path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LAMA spec: %v", err)
+	}
+
+	s, err := parseSpec(b, parser)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LAMA spec %s: %v", path, err)
+	}
+
+	return s, nil
+}
+
+// parseSpec parses and validates a spec file.
+func parseSpec(b []byte, parser koanf.Parser) (*Spec, error) {
+	ko := koanf.New(".")
+	if err := ko.Load(specBytes(b), parser); err != nil {
+		return nil, err
+	}
+
+	var f specFile
+	if err := ko.Unmarshal("", &f); err != nil {
+		return nil, err
+	}
+
+	if f.Version == "" {
+		return nil, errors.New("version is required")
+	}
+	if len(f.Categories) == 0 {
+		return nil, errors.New("no categories")
+	}
+
+	s := &Spec{Version: f.Version}
+	for i, fc := range f.Categories {
+		if !reCategoryName.MatchString(fc.Name) {
+			return nil, fmt.Errorf("category %d: invalid name %q, use lowercase letters, digits and _", i+1, fc.Name)
+		}
+		if _, ok := s.Category(fc.Name); ok {
+			return nil, fmt.Errorf("category %s: duplicate name", fc.Name)
+		}
+		if !strings.HasPrefix(fc.Path, "/") {
+			return nil, fmt.Errorf("category %s: path must start with /", fc.Name)
+		}
+		if len(fc.Measures) == 0 {
+			return nil, fmt.Errorf("category %s: no measures", fc.Name)
+		}
+
+		c := Category{Name: fc.Name, Path: fc.Path}
+		queries := make(map[string]bool, len(fc.Measures))
+		for j, fm := range fc.Measures {
+			switch {
+			case fm.Key == "":
+				return nil, fmt.Errorf("category %s: measure %d: key is required", fc.Name, j+1)
+			case fm.Query == "":
+				return nil, fmt.Errorf("category %s: measure %s: query is required", fc.Name, fm.Key)
+			case fm.Precision != nil && (*fm.Precision < 0 || *fm.Precision > maxPrecision):
+				return nil, fmt.Errorf("category %s: measure %s: precision must be between 0 and %d", fc.Name, fm.Key, maxPrecision)
+			}
+			if _, ok := c.Measure(fm.Key); ok {
+				return nil, fmt.Errorf("category %s: measure %s: duplicate key", fc.Name, fm.Key)
+			}
+			if queries[fm.Query] {
+				return nil, fmt.Errorf("category %s: measure %s: query %s is used by another measure", fc.Name, fm.Key, fm.Query)
+			}
+			queries[fm.Query] = true
+
+			m := Measure{
+				Key:       fm.Key,
+				Query:     fm.Query,
+				Precision: NoPrecision,
+				Percent:   fm.Percent,
+				Required:  fm.Required,
+			}
+			if fm.Precision != nil {
+				m.Precision = *fm.Precision
+			}
+			switch fm.Kind {
+			case kindSimple:
+				m.Kind = Simple
+			case kindSummary:
+				m.Kind = Summary
+			default:
+				return nil, fmt.Errorf("category %s: measure %s: unknown kind %q, use %s or %s", fc.Name, fm.Key, fm.Kind, kindSimple, kindSummary)
+			}
+
+			c.Measures = append(c.Measures, m)
+		}
+
+		s.Categories = append(s.Categories, c)
+	}
+
+	return s, nil
+}
+
+// Names returns the names of the categories.
+func (s *Spec) Names() []string {
+	names := make([]string, 0, len(s.Categories))
+	for _, c := range s.Categories {
+		names = append(names, c.Name)
+	}
+
+	return names
+}
+
+// Category returns the category with the given name.
+func (s *Spec) Category(name string) (Category, bool) {
+	for _, c := range s.Categories {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return Category{}, false
+}
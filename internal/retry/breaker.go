@@ -0,0 +1,159 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// StateClosed lets all calls through.
+	StateClosed State = iota
+
+	// StateHalfOpen lets a single probe call through to check if the
+	// upstream has recovered.
+	StateHalfOpen
+
+	// StateOpen rejects all calls until the cooldown has elapsed.
+	StateOpen
+)
+
+// ErrOpen is returned by Breaker.Allow while the breaker is open.
+var ErrOpen = errors.New("circuit breaker is open")
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	}
+
+	return "unknown"
+}
+
+// Breaker is a circuit breaker. It opens after Threshold consecutive
+// failures, rejects calls for Cooldown and then lets a single probe through.
+// The probe's result closes the breaker or opens it again.
+type Breaker struct {
+	sync.Mutex
+
+	name      string
+	threshold int
+	cooldown  time.Duration
+	onChange  func(name string, from, to State)
+
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a closed breaker. A threshold of 0 disables the breaker.
+// onChange, if set, is called on every state transition.
+func NewBreaker(name string, threshold int, cooldown time.Duration, onChange func(name string, from, to State)) *Breaker {
+	return &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		onChange:  onChange,
+	}
+}
+
+// Allow returns ErrOpen if a call must not be made now. Otherwise the caller
+// must report the outcome of the call with Success or Failure.
+func (b *Breaker) Allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrOpen
+		}
+		b.setState(StateHalfOpen)
+		b.probing = true
+		return nil
+
+	case StateHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+// Success records a successful call and closes the breaker.
+func (b *Breaker) Success() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != StateClosed {
+		b.setState(StateClosed)
+	}
+}
+
+// Failure records a failed call. The breaker opens once the threshold of
+// consecutive failures is reached, or right away if the call was a probe.
+func (b *Breaker) Failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == StateHalfOpen || (b.state == StateClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(StateOpen)
+	}
+}
+
+// Abort releases a call allowed by Allow whose outcome is unknown, eg: when
+// it was cancelled, without changing the state of the breaker.
+func (b *Breaker) Abort() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.Lock()
+	b.probing = false
+	b.Unlock()
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.state
+}
+
+func (b *Breaker) setState(s State) {
+	from := b.state
+	b.state = s
+	if b.onChange != nil {
+		b.onChange(b.name, from, s)
+	}
+}
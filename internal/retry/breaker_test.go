@@ -0,0 +1,159 @@
+package retry
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCooldown = 20 * time.Millisecond
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		// op is one of allow, deny, success, failure, abort or wait (for the
+		// cooldown).
+		op   string
+		want State
+	}
+
+	tests := []struct {
+		name        string
+		threshold   int
+		steps       []step
+		transitions []string
+	}{
+		{
+			name:      "opens after threshold failures",
+			threshold: 3,
+			steps: []step{
+				{"allow", StateClosed}, {"failure", StateClosed},
+				{"allow", StateClosed}, {"failure", StateClosed},
+				{"allow", StateClosed}, {"failure", StateOpen},
+				{"deny", StateOpen},
+			},
+			transitions: []string{"closed>open"},
+		},
+		{
+			name:      "success resets the failures",
+			threshold: 2,
+			steps: []step{
+				{"allow", StateClosed}, {"failure", StateClosed},
+				{"allow", StateClosed}, {"success", StateClosed},
+				{"allow", StateClosed}, {"failure", StateClosed},
+			},
+		},
+		{
+			name:      "probe closes",
+			threshold: 1,
+			steps: []step{
+				{"allow", StateClosed}, {"failure", StateOpen},
+				{"wait", StateOpen},
+				{"allow", StateHalfOpen},
+				{"deny", StateHalfOpen},
+				{"success", StateClosed},
+				{"allow", StateClosed},
+			},
+			transitions: []string{"closed>open", "open>half-open", "half-open>closed"},
+		},
+		{
+			name:      "probe opens again",
+			threshold: 2,
+			steps: []step{
+				{"allow", StateClosed}, {"failure", StateClosed},
+				{"allow", StateClosed}, {"failure", StateOpen},
+				{"wait", StateOpen},
+				{"allow", StateHalfOpen}, {"failure", StateOpen},
+				{"deny", StateOpen},
+			},
+			transitions: []string{"closed>open", "open>half-open", "half-open>open"},
+		},
+		{
+			name:      "aborted probe lets another through",
+			threshold: 1,
+			steps: []step{
+				{"allow", StateClosed}, {"failure", StateOpen},
+				{"wait", StateOpen},
+				{"allow", StateHalfOpen}, {"abort", StateHalfOpen},
+				{"allow", StateHalfOpen}, {"success", StateClosed},
+			},
+			transitions: []string{"closed>open", "open>half-open", "half-open>closed"},
+		},
+		{
+			name:      "disabled",
+			threshold: 0,
+			steps: []step{
+				{"allow", StateClosed}, {"failure", StateClosed},
+				{"allow", StateClosed}, {"failure", StateClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var transitions []string
+			b := NewBreaker("test", tt.threshold, testCooldown, func(name string, from, to State) {
+				transitions = append(transitions, fmt.Sprintf("%s>%s", from, to))
+			})
+
+			for i, s := range tt.steps {
+				switch s.op {
+				case "allow":
+					if err := b.Allow(); err != nil {
+						t.Fatalf("step %d: Allow() error = %v", i, err)
+					}
+				case "deny":
+					if err := b.Allow(); err != ErrOpen {
+						t.Fatalf("step %d: Allow() error = %v, want %v", i, err, ErrOpen)
+					}
+				case "success":
+					b.Success()
+				case "failure":
+					b.Failure()
+				case "abort":
+					b.Abort()
+				case "wait":
+					time.Sleep(testCooldown)
+				}
+
+				if got := b.State(); got != s.want {
+					t.Fatalf("step %d (%s): State() = %s, want %s", i, s.op, got, s.want)
+				}
+			}
+
+			if !slices.Equal(transitions, tt.transitions) {
+				t.Errorf("transitions = %v, want %v", transitions, tt.transitions)
+			}
+		})
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := NewBreaker("test", 1, testCooldown, nil)
+	b.Allow()
+	b.Failure()
+	time.Sleep(testCooldown)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.Allow() == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Errorf("%d probes allowed at once, want 1", allowed)
+	}
+}
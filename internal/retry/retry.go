@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy is an exponential backoff retry policy with jitter.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. It's doubled for every
+	// subsequent retry up to MaxDelay.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between retries. 0 means no cap.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction (0-1) of the delay that's randomised to avoid
+	// retries from different workers lining up.
+	Jitter float64
+
+	// Retryable decides whether an error is worth retrying. If it's nil,
+	// every error is retried.
+	Retryable func(error) bool
+
+	// OnRetry, if set, is called before sleeping for a retry.
+	OnRetry func(attempt int, delay time.Duration, err error)
+}
+
+// Backoff returns the delay before the given retry (1 for the first retry).
+func (p Policy) Backoff(retry int) time.Duration {
+	if retry < 1 {
+		retry = 1
+	}
+
+	d := float64(p.BaseDelay) * math.Pow(2, float64(retry-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+
+	// Spread the delay uniformly over [d - jitter, d + jitter], without
+	// going over the cap.
+	if p.Jitter > 0 {
+		j := d * math.Min(p.Jitter, 1)
+		d = d - j + rand.Float64()*2*j
+		if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+			d = float64(p.MaxDelay)
+		}
+	}
+
+	return time.Duration(d)
+}
+
+// Do calls fn until it succeeds, returns an error that's not retryable,
+// MaxAttempts is reached or ctx is done. It returns the last error.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if attempt >= p.MaxAttempts || (p.Retryable != nil && !p.Retryable(err)) {
+			return err
+		}
+
+		delay := p.Backoff(attempt)
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, delay, err)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
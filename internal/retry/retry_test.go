@@ -0,0 +1,112 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		retry    int
+		min, max time.Duration
+	}{
+		{name: "first retry", policy: Policy{BaseDelay: time.Second}, retry: 1, min: time.Second, max: time.Second},
+		{name: "retry 0 is the first", policy: Policy{BaseDelay: time.Second}, retry: 0, min: time.Second, max: time.Second},
+		{name: "doubled", policy: Policy{BaseDelay: time.Second}, retry: 4, min: 8 * time.Second, max: 8 * time.Second},
+		{name: "capped", policy: Policy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}, retry: 10, min: 5 * time.Second, max: 5 * time.Second},
+		{name: "no cap", policy: Policy{BaseDelay: time.Second}, retry: 11, min: 1024 * time.Second, max: 1024 * time.Second},
+		{name: "jitter", policy: Policy{BaseDelay: time.Second, Jitter: 0.2}, retry: 2, min: 1600 * time.Millisecond, max: 2400 * time.Millisecond},
+		{name: "jitter above 1", policy: Policy{BaseDelay: time.Second, Jitter: 3}, retry: 1, min: 0, max: 2 * time.Second},
+		{name: "jitter under the cap", policy: Policy{BaseDelay: time.Second, MaxDelay: 4 * time.Second, Jitter: 0.5}, retry: 5, min: 2 * time.Second, max: 4 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 1000; i++ {
+				d := tt.policy.Backoff(tt.retry)
+				if d < tt.min || d > tt.max {
+					t.Fatalf("Backoff(%d) = %s, want between %s and %s", tt.retry, d, tt.min, tt.max)
+				}
+				seen[d] = true
+			}
+
+			// Jitter spreads the delays.
+			if tt.policy.Jitter > 0 && len(seen) < 100 {
+				t.Errorf("Backoff(%d) returned %d distinct delays in 1000 calls", tt.retry, len(seen))
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	var (
+		errRetryable = errors.New("retryable")
+		errPermanent = errors.New("permanent")
+	)
+
+	tests := []struct {
+		name     string
+		attempts int
+		errs     []error
+		wantErr  error
+		wantRuns int
+	}{
+		{name: "success", attempts: 3, errs: []error{nil}, wantRuns: 1},
+		{name: "success after retries", attempts: 3, errs: []error{errRetryable, errRetryable, nil}, wantRuns: 3},
+		{name: "max attempts", attempts: 3, errs: []error{errRetryable, errRetryable, errRetryable, nil}, wantErr: errRetryable, wantRuns: 3},
+		{name: "not retryable", attempts: 3, errs: []error{errPermanent, nil}, wantErr: errPermanent, wantRuns: 1},
+		{name: "no retries", attempts: 0, errs: []error{errRetryable, nil}, wantErr: errRetryable, wantRuns: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var retries []int
+			p := Policy{
+				MaxAttempts: tt.attempts,
+				BaseDelay:   time.Millisecond,
+				Retryable:   func(err error) bool { return err == errRetryable },
+				OnRetry: func(attempt int, delay time.Duration, err error) {
+					retries = append(retries, attempt)
+				},
+			}
+
+			runs := 0
+			err := p.Do(context.Background(), func(ctx context.Context) error {
+				runs++
+				return tt.errs[runs-1]
+			})
+			if err != tt.wantErr {
+				t.Errorf("Do() error = %v, want %v", err, tt.wantErr)
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("Do() ran %d times, want %d", runs, tt.wantRuns)
+			}
+			if len(retries) != tt.wantRuns-1 {
+				t.Errorf("OnRetry() called for %v, want %d retries", retries, tt.wantRuns-1)
+			}
+		})
+	}
+}
+
+func TestDoCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := Policy{
+		MaxAttempts: 10,
+		BaseDelay:   time.Hour,
+		OnRetry:     func(int, time.Duration, error) { cancel() },
+	}
+
+	start := time.Now()
+	err := p.Do(ctx, func(ctx context.Context) error { return errors.New("failed") })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() error = %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Do() waited for the retry after ctx was done")
+	}
+}
@@ -0,0 +1,333 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	fileExt = ".json"
+
+	// badExt is appended to the file of an entry that can't be read, to set
+	// it aside for inspection instead of replaying it.
+	badExt = ".bad"
+)
+
+// Opts are the options for the spool.
+type Opts struct {
+	// Dir is the directory in which entries are stored, one file per entry.
+	Dir string
+
+	// MaxEntries is the maximum number of entries kept in the spool. When
+	// it's full, the oldest entry is dropped. 0 means no limit.
+	MaxEntries int
+
+	// MaxAge is the maximum age of an entry. Older entries are dropped
+	// instead of being replayed. 0 means no limit.
+	MaxAge time.Duration
+}
+
+// Entry is a LAMA request that could not be submitted, or the interval of a
+// location whose metrics could not be fetched.
+type Entry struct {
+	// ID is the name of the entry's file in the spool. Entries are replayed
+	// in the lexical order of their IDs, which is the order they were added.
+	ID string `json:"-"`
+
+	Endpoint   string    `json:"endpoint"`
+	Host       string    `json:"host"`
+	LocationID int       `json:"location_id"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Request is empty if the metrics of the location couldn't be fetched.
+	// They're fetched as of CreatedAt when the entry is replayed.
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// Spool is a disk-backed store-and-forward queue of failed LAMA requests.
+type Spool struct {
+	sync.Mutex
+
+	lo   *slog.Logger
+	opts Opts
+
+	// seq disambiguates entries added within the same nanosecond.
+	seq int
+
+	// depth is the number of entries per endpoint.
+	depth map[string]int
+}
+
+// New returns a spool backed by opts.Dir, creating it if required.
+func New(opts Opts, lo *slog.Logger) (*Spool, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	s := &Spool{
+		lo:    lo,
+		opts:  opts,
+		depth: make(map[string]int),
+	}
+
+	entries, err := s.Entries("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		s.depth[e.Endpoint]++
+	}
+
+	if len(entries) > 0 {
+		lo.Info("loaded spooled requests", "count", len(entries), "depth", s.depth)
+	}
+
+	return s, nil
+}
+
+// Add writes an entry to the spool. If the spool is full, the oldest entry
+// is dropped to make room.
+func (s *Spool) Add(e Entry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.opts.MaxEntries > 0 {
+		ids, err := s.ids()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i <= len(ids)-s.opts.MaxEntries; i++ {
+			old, err := s.read(ids[i])
+			if err != nil {
+				s.quarantine(ids[i], err)
+				continue
+			}
+
+			s.lo.Warn("spool is full, dropping oldest request", "endpoint", old.Endpoint, "location_id", old.LocationID, "created_at", old.CreatedAt)
+			if err := s.remove(old); err != nil {
+				return err
+			}
+		}
+	}
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+
+	e.ID = s.newID(e.Endpoint)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spool entry: %v", err)
+	}
+
+	if err := writeFile(filepath.Join(s.opts.Dir, e.ID+fileExt), b); err != nil {
+		return err
+	}
+	s.depth[e.Endpoint]++
+
+	return nil
+}
+
+// Entries returns the entries of an endpoint, oldest first. An empty
+// endpoint returns the entries of all endpoints. Entries older than
+// MaxAge are dropped, and entries that can't be read are quarantined.
+func (s *Spool) Entries(endpoint string) ([]Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		ep, ok := parseID(id)
+		if !ok {
+			s.quarantine(id, errors.New("invalid entry ID"))
+			continue
+		}
+		if endpoint != "" && ep != endpoint {
+			continue
+		}
+
+		e, err := s.read(id)
+		if err != nil {
+			s.quarantine(id, err)
+			continue
+		}
+
+		if s.opts.MaxAge > 0 && time.Since(e.CreatedAt) > s.opts.MaxAge {
+			s.lo.Warn("dropping expired spooled request", "endpoint", e.Endpoint, "location_id", e.LocationID, "created_at", e.CreatedAt)
+			if err := s.remove(e); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		out = append(out, e)
+	}
+
+	return out, nil
+}
+
+// Remove deletes an entry from the spool, typically after it has been
+// replayed successfully.
+func (s *Spool) Remove(e Entry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.remove(e)
+}
+
+// Depth returns the number of entries of an endpoint.
+func (s *Spool) Depth(endpoint string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.depth[endpoint]
+}
+
+func (s *Spool) remove(e Entry) error {
+	if err := os.Remove(filepath.Join(s.opts.Dir, e.ID+fileExt)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove spool entry: %v", err)
+	}
+
+	if s.depth[e.Endpoint] > 0 {
+		s.depth[e.Endpoint]--
+	}
+
+	return nil
+}
+
+// quarantine sets aside the file of an entry that can't be read, so that it
+// doesn't hold up the rest of the spool.
+func (s *Spool) quarantine(id string, err error) {
+	path := filepath.Join(s.opts.Dir, id+fileExt)
+	s.lo.Error("quarantining unreadable spooled request", "path", path+badExt, "error", err)
+	if err := os.Rename(path, path+badExt); err != nil {
+		s.lo.Error("failed to quarantine spooled request", "path", path, "error", err)
+		return
+	}
+
+	if ep, ok := parseID(id); ok && s.depth[ep] > 0 {
+		s.depth[ep]--
+	}
+}
+
+// newID returns the ID of a new entry of an endpoint. IDs sort in the order
+// they're created.
+func (s *Spool) newID(endpoint string) string {
+	s.seq++
+	return fmt.Sprintf("%020d-%06d-%s", time.Now().UnixNano(), s.seq%1000000, endpoint)
+}
+
+// parseID returns the endpoint of an entry ID.
+func parseID(id string) (string, bool) {
+	parts := strings.SplitN(id, "-", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return "", false
+	}
+	for _, p := range parts[:2] {
+		if _, err := strconv.ParseUint(p, 10, 64); err != nil {
+			return "", false
+		}
+	}
+
+	return parts[2], true
+}
+
+// ids returns the IDs of all the entries in the spool, oldest first.
+func (s *Spool) ids() ([]string, error) {
+	files, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %v", err)
+	}
+
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(f.Name(), fileExt))
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *Spool) read(id string) (Entry, error) {
+	b, err := os.ReadFile(filepath.Join(s.opts.Dir, id+fileExt))
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to read spool entry: %v", err)
+	}
+
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Entry{}, fmt.Errorf("failed to parse spool entry %s: %v", id, err)
+	}
+	if ep, _ := parseID(id); e.Endpoint != ep {
+		return Entry{}, fmt.Errorf("spool entry %s is for endpoint %q", id, e.Endpoint)
+	}
+	e.ID = id
+
+	return e, nil
+}
+
+// writeFile atomically writes b to path via a fsync'd temporary file.
+func writeFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, ".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary spool file: %v", err)
+	}
+	// Cleanup the temporary file if anything below fails. After a successful
+	// rename this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary spool file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary spool file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary spool file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+
+	// Sync the directory so that the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open spool directory: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool directory: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package spool
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newTestSpool(t *testing.T, opts Opts) *Spool {
+	t.Helper()
+
+	if opts.Dir == "" {
+		opts.Dir = t.TempDir()
+	}
+	s, err := New(opts, testLogger)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return s
+}
+
+func add(t *testing.T, s *Spool, endpoint string, locationID int, createdAt time.Time) {
+	t.Helper()
+
+	if err := s.Add(Entry{
+		Endpoint:   endpoint,
+		LocationID: locationID,
+		CreatedAt:  createdAt,
+		Request:    json.RawMessage(`{}`),
+	}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+}
+
+func locations(entries []Entry) []int {
+	out := make([]int, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e.LocationID)
+	}
+
+	return out
+}
+
+func TestEntries(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		opts     Opts
+		add      []Entry
+		endpoint string
+		want     []int
+		depth    map[string]int
+	}{
+		{
+			name:  "in the order they were added",
+			add:   []Entry{{Endpoint: "hardware", LocationID: 3}, {Endpoint: "hardware", LocationID: 1}, {Endpoint: "hardware", LocationID: 2}},
+			want:  []int{3, 1, 2},
+			depth: map[string]int{"hardware": 3},
+		},
+		{
+			name:     "of an endpoint",
+			add:      []Entry{{Endpoint: "network", LocationID: 1}, {Endpoint: "hardware", LocationID: 2}, {Endpoint: "network", LocationID: 3}},
+			endpoint: "network",
+			want:     []int{1, 3},
+			depth:    map[string]int{"network": 2, "hardware": 1},
+		},
+		{
+			name:     "endpoint is matched exactly",
+			add:      []Entry{{Endpoint: "app_network", LocationID: 1}, {Endpoint: "network", LocationID: 2}},
+			endpoint: "network",
+			want:     []int{2},
+			depth:    map[string]int{"network": 1, "app_network": 1},
+		},
+		{
+			name:  "oldest are dropped when full",
+			opts:  Opts{MaxEntries: 2},
+			add:   []Entry{{Endpoint: "hardware", LocationID: 1}, {Endpoint: "network", LocationID: 2}, {Endpoint: "hardware", LocationID: 3}},
+			want:  []int{2, 3},
+			depth: map[string]int{"hardware": 1, "network": 1},
+		},
+		{
+			name: "expired are dropped",
+			opts: Opts{MaxAge: time.Hour},
+			add: []Entry{
+				{Endpoint: "hardware", LocationID: 1, CreatedAt: now.Add(-2 * time.Hour)},
+				{Endpoint: "hardware", LocationID: 2, CreatedAt: now.Add(-30 * time.Minute)},
+			},
+			want:  []int{2},
+			depth: map[string]int{"hardware": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSpool(t, tt.opts)
+			for _, e := range tt.add {
+				if e.CreatedAt.IsZero() {
+					e.CreatedAt = now
+				}
+				add(t, s, e.Endpoint, e.LocationID, e.CreatedAt)
+			}
+
+			got, err := s.Entries(tt.endpoint)
+			if err != nil {
+				t.Fatalf("Entries() error = %v", err)
+			}
+			if !slices.Equal(locations(got), tt.want) {
+				t.Errorf("Entries() = %v, want %v", locations(got), tt.want)
+			}
+			for ep, n := range tt.depth {
+				if d := s.Depth(ep); d != n {
+					t.Errorf("Depth(%s) = %d, want %d", ep, d, n)
+				}
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, Opts{Dir: dir})
+	for i := 1; i <= 3; i++ {
+		add(t, s, "hardware", i, time.Now())
+	}
+
+	// Replay the first entry, and fail on the second one.
+	entries, err := s.Entries("hardware")
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if err := s.Remove(entries[0]); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	// The rest are replayed in order after a restart.
+	s = newTestSpool(t, Opts{Dir: dir})
+	if d := s.Depth("hardware"); d != 2 {
+		t.Errorf("Depth() = %d after restart, want 2", d)
+	}
+
+	entries, err = s.Entries("hardware")
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if got := locations(entries); !slices.Equal(got, []int{2, 3}) {
+		t.Errorf("Entries() = %v after restart, want [2 3]", got)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, Opts{Dir: dir, MaxEntries: 3})
+	add(t, s, "hardware", 1, time.Now())
+	add(t, s, "hardware", 2, time.Now())
+
+	entries, err := s.Entries("")
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{name: "corrupt entry", file: entries[0].ID + fileExt, data: "{not json"},
+		{name: "entry of another endpoint", file: "00000000000000000001-000001-network" + fileExt, data: `{"endpoint":"hardware"}`},
+		{name: "invalid ID", file: "junk" + fileExt, data: `{}`},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Startup isn't failed by bad entries.
+	s = newTestSpool(t, Opts{Dir: dir, MaxEntries: 3})
+
+	entries, err = s.Entries("")
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if got := locations(entries); !slices.Equal(got, []int{2}) {
+		t.Errorf("Entries() = %v, want [2]", got)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat(filepath.Join(dir, tt.file+badExt)); err != nil {
+				t.Errorf("%s isn't quarantined: %v", tt.file, err)
+			}
+		})
+	}
+
+	// Nor are the entries added later.
+	for i := 3; i <= 5; i++ {
+		add(t, s, "hardware", i, time.Now())
+	}
+	entries, err = s.Entries("hardware")
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if got := locations(entries); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("Entries() = %v, want [3 4 5]", got)
+	}
+}
@@ -0,0 +1,253 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// ErrLocked is returned by FileStore.LockFile if another process, eg: a running
+// mii-lama, holds the lock of the state file.
+var ErrLocked = errors.New("state file is in use by another process")
+
+// Store persists the last sequence ID acknowledged by LAMA for each endpoint
+// so that a restart resumes the sequence instead of starting over from 1.
+type Store interface {
+	// Load returns the last acknowledged sequence ID of every endpoint.
+	Load() (map[string]int, error)
+
+	// Save records seqID as the last acknowledged sequence ID of an endpoint.
+	Save(endpoint string, seqID int) error
+
+	// Reset removes the stored sequence ID of an endpoint. An empty
+	// endpoint removes all of them.
+	Reset(endpoint string) error
+}
+
+// FileStore is a Store backed by a JSON file on the local disk. Every write
+// goes to a temporary file which is fsync'd and atomically renamed over the
+// original, so a crash never leaves a half written state file behind.
+type FileStore struct {
+	sync.Mutex
+
+	path string
+	seqs map[string]int
+
+	// lock is the open lock file while the lock is held.
+	lock *os.File
+}
+
+// MemoryStore is a Store that keeps sequence IDs in memory only. It is used
+// when persistence is disabled.
+type MemoryStore struct {
+	sync.Mutex
+
+	seqs map[string]int
+}
+
+// NewFileStore returns a FileStore backed by the file at path. If the file
+// exists, its contents are loaded.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		seqs: make(map[string]int),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	if len(b) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(b, &s.seqs); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+
+	return s, nil
+}
+
+// LockFile takes an exclusive lock on the state file, so that the sequence
+// IDs can't be changed by another process while this one keeps them in
+// memory. The lock is held until the process exits. If another process holds
+// it, ErrLocked is returned.
+func (s *FileStore) LockFile() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lock != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open state lock file: %v", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("%w: %s", ErrLocked, s.path)
+		}
+		return fmt.Errorf("failed to lock state file: %v", err)
+	}
+	s.lock = f
+
+	return nil
+}
+
+// Load returns the last acknowledged sequence ID of every endpoint.
+func (s *FileStore) Load() (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return copySeqs(s.seqs), nil
+}
+
+// Save records seqID as the last acknowledged sequence ID of an endpoint
+// and flushes the state to disk.
+func (s *FileStore) Save(endpoint string, seqID int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	seqs := copySeqs(s.seqs)
+	seqs[endpoint] = seqID
+
+	if err := s.write(seqs); err != nil {
+		return err
+	}
+	s.seqs = seqs
+
+	return nil
+}
+
+// Reset removes the stored sequence ID of an endpoint and flushes the
+// state to disk. An empty endpoint removes all of them.
+func (s *FileStore) Reset(endpoint string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	seqs := make(map[string]int)
+	if endpoint != "" {
+		seqs = copySeqs(s.seqs)
+		delete(seqs, endpoint)
+	}
+
+	if err := s.write(seqs); err != nil {
+		return err
+	}
+	s.seqs = seqs
+
+	return nil
+}
+
+// write atomically replaces the state file with seqs.
+func (s *FileStore) write(seqs map[string]int) error {
+	b, err := json.MarshalIndent(seqs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	// Cleanup the temporary file if anything below fails. After a successful
+	// rename this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary state file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary state file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+
+	// Sync the directory so that the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open state directory: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync state directory: %v", err)
+	}
+
+	return nil
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		seqs: make(map[string]int),
+	}
+}
+
+// Load returns the last acknowledged sequence ID of every endpoint.
+func (s *MemoryStore) Load() (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return copySeqs(s.seqs), nil
+}
+
+// Save records seqID as the last acknowledged sequence ID of an endpoint.
+func (s *MemoryStore) Save(endpoint string, seqID int) error {
+	s.Lock()
+	s.seqs[endpoint] = seqID
+	s.Unlock()
+
+	return nil
+}
+
+// Reset removes the stored sequence ID of an endpoint. An empty endpoint
+// removes all of them.
+func (s *MemoryStore) Reset(endpoint string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if endpoint == "" {
+		s.seqs = make(map[string]int)
+		return nil
+	}
+	delete(s.seqs, endpoint)
+
+	return nil
+}
+
+func copySeqs(seqs map[string]int) map[string]int {
+	out := make(map[string]int, len(seqs))
+	for k, v := range seqs {
+		out[k] = v
+	}
+
+	return out
+}
@@ -0,0 +1,220 @@
+package state
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		ops   func(s Store) error
+		want  map[string]int
+		setup string
+	}{
+		{
+			name: "save",
+			ops: func(s Store) error {
+				if err := s.Save("hardware", 1); err != nil {
+					return err
+				}
+				if err := s.Save("network", 5); err != nil {
+					return err
+				}
+				return s.Save("hardware", 2)
+			},
+			want: map[string]int{"hardware": 2, "network": 5},
+		},
+		{
+			name:  "load existing",
+			setup: `{"hardware": 7}`,
+			ops: func(s Store) error {
+				return s.Save("network", 3)
+			},
+			want: map[string]int{"hardware": 7, "network": 3},
+		},
+		{
+			name: "concurrent saves",
+			ops: func(s Store) error {
+				var (
+					wg   sync.WaitGroup
+					errs = make(chan error, 40)
+				)
+				for _, ep := range []string{"hardware", "database", "network", "application"} {
+					for i := 1; i <= 10; i++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							errs <- s.Save(ep, len(ep)*100+i)
+						}()
+					}
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					if err != nil {
+						return err
+					}
+				}
+
+				// Leave every endpoint with a known ID.
+				for _, ep := range []string{"hardware", "database", "network", "application"} {
+					if err := s.Save(ep, len(ep)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			want: map[string]int{"hardware": 8, "database": 8, "network": 7, "application": 11},
+		},
+		{
+			name:  "reset an endpoint",
+			setup: `{"hardware": 7, "network": 3}`,
+			ops:   func(s Store) error { return s.Reset("network") },
+			want:  map[string]int{"hardware": 7},
+		},
+		{
+			name:  "reset all",
+			setup: `{"hardware": 7, "network": 3}`,
+			ops:   func(s Store) error { return s.Reset("") },
+			want:  map[string]int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state", "state.json")
+			if tt.setup != "" {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.setup), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := NewFileStore(path)
+			if err != nil {
+				t.Fatalf("NewFileStore() error = %v", err)
+			}
+			if err := tt.ops(s); err != nil {
+				t.Fatalf("error = %v", err)
+			}
+
+			got, _ := s.Load()
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Load() = %v, want %v", got, tt.want)
+			}
+
+			// The state is the same once reloaded from disk, and no
+			// temporary files are left behind.
+			s, err = NewFileStore(path)
+			if err != nil {
+				t.Fatalf("NewFileStore() error = %v on reload", err)
+			}
+			got, _ = s.Load()
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Load() = %v after reload, want %v", got, tt.want)
+			}
+
+			files, err := os.ReadDir(filepath.Dir(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if strings.Contains(f.Name(), ".tmp") {
+					t.Errorf("temporary file %s left behind", f.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"hardware": 7`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileStore(path); err == nil {
+		t.Fatal("NewFileStore() loaded a corrupt state file")
+	}
+
+	// The corrupt file is left as it is for inspection.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"hardware": 7` {
+		t.Errorf("corrupt state file was changed: %q", b)
+	}
+}
+
+func TestFileStoreWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	if err := s.Save("hardware", 1); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// A failed write leaves both the file and the sequence IDs in memory
+	// as they were.
+	if err := os.Chmod(dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o755)
+	if f, err := os.CreateTemp(dir, "probe"); err == nil {
+		f.Close()
+		os.Remove(f.Name())
+		t.Skip("directory is writable regardless of its permissions")
+	}
+
+	if err := s.Save("hardware", 2); err == nil {
+		t.Fatal("Save() succeeded in a read-only directory")
+	}
+	if got, _ := s.Load(); got["hardware"] != 1 {
+		t.Errorf("Load() = %v after a failed save, want hardware: 1", got)
+	}
+
+	os.Chmod(dir, 0o755)
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	if got, _ := s.Load(); got["hardware"] != 1 {
+		t.Errorf("Load() = %v from disk after a failed save, want hardware: 1", got)
+	}
+}
+
+func TestFileStoreLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	a, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	if err := a.LockFile(); err != nil {
+		t.Fatalf("LockFile() error = %v", err)
+	}
+	if err := a.LockFile(); err != nil {
+		t.Errorf("LockFile() error = %v when already held", err)
+	}
+
+	b, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	if err := b.LockFile(); !errors.Is(err, ErrLocked) {
+		t.Errorf("LockFile() error = %v, want ErrLocked", err)
+	}
+}
@@ -1,28 +1,12 @@
 package models
 
-// HWPromResp is the response from the Prometheus HTTP API for hardware metrics.
-type HWPromResp struct {
-	CPU    float64 `json:"cpu"`
-	Mem    float64 `json:"mem"`
-	Disk   float64 `json:"disk"`
-	Uptime float64 `json:"uptime"`
-}
-
-// DBPromResp is the response from the Prometheus HTTP API for database metrics.
-type DBPromResp struct {
-	Status float64 `json:"status"`
-}
-
-// NetworkPromResp is the response from the Prometheus HTTP API for network metrics.
-type NetworkPromResp struct {
-	PacketErrors float64 `json:"packet_errors"`
-}
-
-// AppPromResp is the response from the Prometheus HTTP API for application metrics.
-type AppPromResp struct {
-	Throughput   float64 `json:"throughput"`
-	FailureCount float64 `json:"failure_count"`
-}
+// Samples are the samples fetched from Prometheus for the measures of a
+// category at a location, by query name. Measures that are reported to LAMA
+// as a simple value hold a single (instant) sample, while the rest are
+// reported as min/max/avg/median of the samples over the last sync interval.
+// A measure with no samples (no query configured or a failed query) is left
+// out of the LAMA payload.
+type Samples map[string][]float64
 
 // AppMetric represents an individual application metric.
 type AppMetric struct {